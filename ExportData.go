@@ -3,22 +3,44 @@ package main
 import (
     "bufio"
     "compress/gzip"
+    "context"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
     "database/sql"
+    "database/sql/driver"
+    "encoding/binary"
+    "encoding/hex"
+    "encoding/json"
     "flag"
     "fmt"
     "io"
     "io/ioutil"
     "os"
+    "os/exec"
     "path/filepath"
     "regexp"
+    "runtime"
+    "sort"
     "strconv"
     "strings"
     "sync"
+    "sync/atomic"
     "syscall"
+    "text/template"
     "time"
+    "unicode"
+    "unicode/utf16"
+    "unicode/utf8"
 
+    "golang.org/x/crypto/scrypt"
     "golang.org/x/crypto/ssh/terminal"
-    _ "github.com/godror/godror"
+    "golang.org/x/text/encoding/charmap"
+    "gopkg.in/yaml.v3"
+    "github.com/godror/godror"
+    _ "github.com/snowflakedb/gosnowflake"
 )
 
 type Params struct {
@@ -29,15 +51,415 @@ type Params struct {
     Compress            bool
     DoubleQuotes 		bool
     TabSeparated 		bool
+    Stream              *Stream
+    Manifest            *Manifest
+    SfConnStr           string
+    SfStage             string
+    SfTable             string
+    TargetDriver        string
+    TargetConnStr       string
+    TargetTable         string
+    InsertBatch         int
+    DDL                 []string
+    DDLTable            string
+    SfNumber            string
+    Loaders             []string
+    Format              Format
+    Encoding            string
+    EncodingStrict      bool
+    BOM                 bool
+    Credentials         Credentials
+    Vars                Vars
+    Binds               map[string]interface{}
+    Pre                 []string
+    Post                []string
+    FetchOptions        []interface{}
+    FormatWorkers       int
+    Ordered             bool
+    PipelineBuffer      int
+    Writers             int
+    TargetRows          int
+    TargetTime          time.Duration
+    MinBatch            int
+    MaxBatch            int
+    RangeTimeout        time.Duration
+    Metrics             *PipelineMetrics
+    Progress            *Progress
 }
 
+// SecretProvider returns a secret by name, connection strings
+// reference secrets as ${secret:name}
+type SecretProvider interface {
+    Secret(name string) (string, error)
+}
+
+// KeyringProvider reads secrets from a file encrypted with AES-256-GCM,
+// the key is derived from a passphrase with scrypt
+type KeyringProvider struct {
+    FileName    string
+    Passphrase  string
+}
+
+// ExecProvider runs a command with the secret name as the last argument
+// and reads the secret from its stdout
+type ExecProvider struct {
+    Command     string
+}
+
+// Keyring file content
+type keyringFile struct {
+    Salt    []byte
+    Nonce   []byte
+    Data    []byte
+}
+
+// Config is a file with named connections, profiles and export jobs,
+// profiles and jobs set flags by their names
+type Config struct {
+    Connections map[string]string                   `yaml:"connections"`
+    Profiles    map[string]map[string]interface{}   `yaml:"profiles"`
+    Jobs        map[string]map[string]interface{}   `yaml:"jobs"`
+}
+
+// Queryer is a connection pool or a single connection
+type Queryer interface {
+    QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Vars are template variables of the query, set by -var key=value
+type Vars map[string]string
+
+// Named bind variable, like :range_start
+var namedBind = regexp.MustCompile(`:([A-Za-z_][A-Za-z0-9_$#]*)`)
+
+// ${NAME} variable of the query
+var queryVar = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Execer is a connection pool or a single connection
+type Execer interface {
+    ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// QueryFile is a query file with sections of session setup statements,
+// pre-export statements, the query and post-export statements
+type QueryFile struct {
+    Session []string
+    Pre     []string
+    Query   string
+    Post    []string
+}
+
+// Section marker of the query file, like -- @pre
+var sectionMarker = regexp.MustCompile(`(?i)^\s*--\s*@(session|pre|query|post)\s*$`)
+
+// PL/SQL blocks end with a line of /
+var plsqlBlock = regexp.MustCompile(`(?is)^\s*(declare|begin|create\s+(or\s+replace\s+)?(editionable\s+|noneditionable\s+)?(procedure|function|package|trigger|type))\b`)
+
+// Default statements run on every new session, session statements of query files are added
+var SessionStatements = []string{
+    "alter session set time_zone='UTC'",
+    "alter session set NLS_NUMERIC_CHARACTERS = '. '",
+}
+
+// Watermark is the state of the incremental export, the high-water mark
+// of the last successful export
+type Watermark struct {
+    Column      string      `json:"column"`
+    Type        string      `json:"type"`
+    Value       string      `json:"value"`
+    Start       string      `json:"start,omitempty"`
+    Files       []string    `json:"files"`
+    Time        time.Time   `json:"time"`
+}
+
+// SchemaTable is a table of the schema export
+type SchemaTable struct {
+    Name        string
+    Columns     []string
+    RangeColumn string
+}
+
+// BatchResult is a line of the batch summary
+type BatchResult struct {
+    Name        string
+    Rows        int
+    Files       int
+    Duration    time.Duration
+    Err         error
+}
+
+// Secrets resolves ${secret:name} references, nil if no provider is configured
+var Secrets SecretProvider
+
+// Credentials are the password sources of ReadPassword
+type Credentials struct {
+    PasswordEnv     string
+    PasswordFile    string
+    PasswordStdin   bool
+    External        bool
+}
+
+// LobString reads a CLOB value fetched inline as a string or through its locator
+type LobString struct {
+    sql.NullString
+}
+
+// BenchResult is a line of the fetch benchmark
+type BenchResult struct {
+    ArraySize   int
+    Prefetch    int
+    Rows        int
+    Duration    time.Duration
+    Err         error
+}
+
+// Formatter appends the field of a scanned value of its column to the line,
+// formatters are resolved once per query by DefineColumnTypes
+type Formatter func(buf []byte, value interface{}) []byte
+
+// RowBatch is a batch of formatted lines passed to the writer, Seq is the
+// order of the batch in the pipeline. Batches are reused through batchPool
+type RowBatch struct {
+    Lines   []byte
+    Rows    int
+    Seq     int
+}
+
+// RawBatch is a batch of scanned rows passed from ScanRows to the format workers
+type RawBatch struct {
+    Values      [][]interface{}
+    Rows        int
+    Seq         int
+    Formatters  []Formatter
+    pool        *sync.Pool
+}
+
+// Pipeline is fetch -> format workers -> writers -> compressors of one connection,
+// the stages are connected by buffered channels of batches
+type Pipeline struct {
+    params      Params
+    seq         int
+    cRaw        chan *RawBatch
+    cRows       chan *RowBatch
+    formatWG    sync.WaitGroup
+    writerWG    sync.WaitGroup
+}
+
+// StageMetrics are counters of a pipeline stage shared by its goroutines:
+// busy time in nanoseconds, the maximum of batches waiting in the input channel
+// and the maximum of bytes held by the stage
+type StageMetrics struct {
+    Name        string
+    Rows        int64
+    Bytes       int64
+    Batches     int64
+    Busy        int64
+    MaxQueued   int64
+    MaxHeld     int64
+}
+
+// PipelineMetrics are the metrics of all pipelines of the export
+type PipelineMetrics struct {
+    Fetch       StageMetrics
+    Format      StageMetrics
+    Write       StageMetrics
+    Compress    StageMetrics
+}
+
+// Progress counts rows, bytes and ranges of the export for the progress reporter.
+// Bytes are uncompressed, Written are bytes written to files
+type Progress struct {
+    Rows        int64
+    Bytes       int64
+    Written     int64
+    Ranges      int64
+    RangesTotal int64
+    Keys        int64
+    KeysTotal   int64
+    start       time.Time
+    mode        string
+    mu          sync.Mutex
+    workers     map[int]*WorkerProgress
+    done        chan struct{}
+    stopped     sync.WaitGroup
+}
+
+// WorkerProgress are the counters of one connection
+type WorkerProgress struct {
+    Rows        int64
+    Bytes       int64
+    Written     int64
+    Ranges      int64
+    QueryTime   int64
+}
+
+// ProgressWriter counts bytes written to a file
+type ProgressWriter struct {
+    w           io.Writer
+    p           *Progress
+    worker      *WorkerProgress
+}
+
+// Batch limits of FetchRows
+const (
+    BatchRows   = 1000
+    BatchBytes  = 256 * 1024
+)
+
+var batchPool = sync.Pool{New: func() interface{} {
+    return &RowBatch{Lines: make([]byte, 0, BatchBytes)}
+}}
+
 type Range struct {
     FirstValue  int
     LastValue   int
 }
 
+// RangeResult is sent back by a range worker for every range
+type RangeResult struct {
+    Range       Range
+    Rows        int
+    Duration    time.Duration
+    Timeout     bool
+    Err         error
+}
+
+// RangeSizer adapts the width of ranges to TargetRows rows or TargetTime per range
+type RangeSizer struct {
+    TargetRows  int
+    TargetTime  time.Duration
+    MinWidth    int
+    MaxWidth    int
+    rowsPerKey  float64
+    timePerKey  float64
+    ranges      int
+}
+
+// MaxRangeWidth keeps the last value of a range from overflowing
+const MaxRangeWidth = 1 << 40
+
+// Format of delimited output, fields are quoted as in RFC 4180.
+// Quoting is text (text and date time values), all, minimal or none,
+// Escape is double (doubled quote) or backslash
+type Format struct {
+    Sep         string
+    Quote       string
+    Escape      string
+    Null        string
+    Quoting     string
+    LineEnd     string
+    TimeLayouts map[string]string
+    Location    *time.Location
+    Number      string
+    DecimalSep  string
+    Masks       map[string]Mask
+    MaskSalt    []byte
+    escaper     *strings.Replacer
+}
+
+// Mask is a transformation of column values: hash, redact, truncate, token
+// (format-preserving) or fake, with an optional argument after ':'
+type Mask struct {
+    Kind    string
+    Arg     string
+}
+
+// Decimal is an exact decimal number: Digits * 10^Exp,
+// Digits has no leading and trailing zeros and is empty for zero
+type Decimal struct {
+    Neg     bool
+    Digits  string
+    Exp     int
+}
+
+// Stream is a single output (stdout or a named pipe) shared by all writers,
+// used instead of rotated files
+type Stream struct {
+    mu      sync.Mutex
+    f       *os.File
+    gz      *gzip.Writer
+    w       *bufio.Writer
+}
+
+// ExportFile is a finished output file with its row count
+type ExportFile struct {
+    Name    string
+    Rows    int
+}
+
+// Manifest collects finished files and errors of all writers
+type Manifest struct {
+    mu          sync.Mutex
+    Files       []ExportFile
+    Errors      []error
+    ColumnTypes []*sql.ColumnType
+    Replaced    int
+}
+
+// Charset is an output encoding with its names in loader files
+type Charset struct {
+    Charmap     *charmap.Charmap
+    Snowflake   string
+    Oracle      string
+    Postgres    string
+}
+
+var Charsets = map[string]Charset{
+    "utf-8":        {nil, "UTF8", "AL32UTF8", "UTF8"},
+    "utf-16le":     {nil, "UTF16LE", "AL16UTF16LE", ""},
+    "utf-16be":     {nil, "UTF16BE", "AL16UTF16", ""},
+    "windows-1250": {charmap.Windows1250, "WINDOWS1250", "EE8MSWIN1250", "WIN1250"},
+    "windows-1251": {charmap.Windows1251, "WINDOWS1251", "CL8MSWIN1251", "WIN1251"},
+    "windows-1252": {charmap.Windows1252, "WINDOWS1252", "WE8MSWIN1252", "WIN1252"},
+    "iso-8859-1":   {charmap.ISO8859_1, "ISO88591", "WE8ISO8859P1", "LATIN1"},
+    "iso-8859-2":   {charmap.ISO8859_2, "ISO88592", "EE8ISO8859P2", "LATIN2"},
+    "iso-8859-5":   {charmap.ISO8859_5, "ISO88595", "CL8ISO8859P5", "ISO_8859_5"},
+    "iso-8859-15":  {charmap.ISO8859_15, "ISO885915", "WE8ISO8859P15", "LATIN9"},
+    "koi8-r":       {charmap.KOI8R, "KOI8R", "CL8KOI8R", "KOI8R"},
+    "cp866":        {charmap.CodePage866, "", "RU8PC866", "WIN866"},
+}
+
+// Encoder converts UTF-8 lines to the output encoding,
+// unmappable characters are replaced with '?' or fail in strict mode.
+// Invalid UTF-8 is replaced with U+FFFD or '?' too, counted in Invalid and logged once
+type Encoder struct {
+    Name        string
+    Strict      bool
+    Replaced    int
+    Invalid     int
+    charset     Charset
+    buf         []byte
+}
+
+// Default Go layouts of date time values by Oracle type,
+// "epoch" and "epochms" are seconds and milliseconds since 1970-01-01 UTC
+var TimeLayouts = map[string]string{
+    "DATE":                             "2006-01-02 15:04:05",
+    "TIMESTAMP":                        "2006-01-02 15:04:05.000000000",
+    "TIMESTAMP WITH TIME ZONE":         "2006-01-02 15:04:05.000000000 -0700",
+    "TIMESTAMP WITH LOCAL TIME ZONE":   "2006-01-02 15:04:05.000000000",
+}
+
+// Log messages go to stderr when rows are streamed to stdout
+var logOut io.Writer = os.Stdout
+
+// The progress bar is redrawn in place, log messages clear it. Set with atomic, 1 is on
+var progressBar int32
+
+func Log(a ...interface{}) {
+    if atomic.LoadInt32(&progressBar) == 1 {
+        fmt.Fprint(logOut, "\r\033[K" + fmt.Sprintln(a...))
+        return
+    }
+    fmt.Fprintln(logOut, a...)
+}
+
 func main() {
     connStr := flag.String("conn", "", "connection string")
+    passwordEnv := flag.String("passwordEnv", "", "environment variable with the password")
+    passwordFile := flag.String("passwordFile", "", "file with the password, permissions 0600")
+    passwordStdin := flag.Bool("passwordStdin", false, "read the password from the first line of stdin")
+    externalAuth := flag.Bool("externalAuth", false, "external authentication (Oracle Wallet, OS), no password")
     queryFileName := flag.String("query", "", "query file name")
     fileName := flag.String("fname", "-", "file name, without extension")
     maxSizeMB := flag.Int("maxsize", 250, "file max size (MB)")
@@ -47,459 +469,4840 @@ func main() {
     rangeStart := flag.String("rangeStart", "-", "range start value")
     rangeEnd := flag.String("rangeEnd", "-", "range end value")
     batchSize := flag.Int("batch", 10000, "batch size (row count)")
+    targetRows := flag.Int("targetRows", 0, "adapt the batch size to this number of rows per range")
+    targetTime := flag.Duration("targetTime", 0, "adapt the batch size to this query time per range")
+    minBatch := flag.Int("minBatch", 1, "minimum adaptive batch size")
+    maxBatch := flag.Int("maxBatch", 0, "maximum adaptive batch size, 0 is no limit")
+    rangeTimeout := flag.Duration("rangeTimeout", 0, "cancel the query of a range after this time and split the range")
 
     doubleQuotes := flag.Bool("doubleQuotes", true, "Double quotes")
     tabSeparated := flag.Bool("tabSeparated", true, "Tab-separated values")
+    lineEnd := flag.String("lineEnd", "LF", "line terminator (LF, CRLF)")
+    delimiter := flag.String("delimiter", "", "field delimiter, overrides tabSeparated, escapes like \\t are allowed")
+    quote := flag.String("quote", "\"", "quote character, empty for no quoting")
+    escape := flag.String("escape", "double", "quote escape style (double, backslash)")
+    null := flag.String("null", "", "NULL representation, for example \\N")
+    quoting := flag.String("quoting", "", "quote policy (text, all, minimal, none), default follows doubleQuotes")
+
+    dateFormat := flag.String("dateFormat", "", "DATE format: Go layout, strftime (%Y-%m-%d), iso8601, rfc3339, epoch, epochms")
+    timestampFormat := flag.String("timestampFormat", "", "TIMESTAMP and TIMESTAMP WITH LOCAL TIME ZONE format")
+    timestampTzFormat := flag.String("timestampTzFormat", "", "TIMESTAMP WITH TIME ZONE format")
+    timezone := flag.String("timezone", "", "convert time zone values to this time zone, for example Europe/Moscow")
+
+    encoding := flag.String("encoding", "utf-8", "output encoding (utf-8, utf-16le, utf-16be, windows-1251, iso-8859-1, ...)")
+    encodingErrors := flag.String("encodingErrors", "replace", "unmappable characters (replace, strict)")
+    bom := flag.Bool("bom", false, "write byte order mark (utf-8, utf-16le, utf-16be)")
+
+    numberFormat := flag.String("numberFormat", "plain", "NUMBER format (plain, fixed, scientific)")
+    decimalSep := flag.String("decimalSep", ".", "decimal separator of NUMBER values")
+
+    mask := flag.String("mask", "", "column masks, for example EMAIL=hash,NAME=fake:name,PHONE=token,NOTE=truncate:10")
+    maskFile := flag.String("maskFile", "", "file with column masks, one COLUMN=mask per line")
+    maskSalt := flag.String("maskSalt", "", "salt of hash, token and fake masks, default is $EXPORT_MASK_SALT")
+
+    toStdout := flag.Bool("stdout", false, "write rows to stdout instead of files")
+    pipeName := flag.String("pipe", "", "write rows to a named pipe instead of files")
+
+    sfConnStr := flag.String("sfConn", "", "Snowflake connection string to load files into")
+    sfStage := flag.String("sfStage", "", "Snowflake stage, default is the table stage")
+    sfTable := flag.String("sfTable", "", "Snowflake table for COPY INTO")
+
+    mode := flag.String("mode", "export", "export to files, copy to a table, measure fetch speed or store a secret in the keyring (export, copy, bench, secret)")
+    targetDriver := flag.String("targetDriver", "godror", "target database driver for copy mode (godror, snowflake)")
+    targetConnStr := flag.String("targetConn", "", "target connection string for copy mode")
+    targetTable := flag.String("targetTable", "", "target table for copy mode")
+    insertBatch := flag.Int("insertBatch", 500, "rows per INSERT in copy mode")
+
+    ddl := flag.String("ddl", "", "write CREATE TABLE files for dialects (oracle,snowflake,postgres,bigquery)")
+    ddlTable := flag.String("ddlTable", "", "table name for CREATE TABLE and loader files, default is the file name")
+    sfNumber := flag.String("sfNumber", "FLOAT", "Snowflake type of NUMBER columns without precision in CREATE TABLE")
+    loaders := flag.String("loaders", "", "write loader files (sqlldr,snowflake,postgres)")
+
+    keyring := flag.String("keyring", "", "encrypted keyring file with secrets, the passphrase is $EXPORT_KEYRING_PASSPHRASE or requested")
+    secretExec := flag.String("secretExec", "", "command printing a secret, the secret name is passed as the last argument")
+    secretName := flag.String("secretName", "", "name of the secret to store with -mode=secret")
 
-    flag.Parse()
+    flag.String("config", "ExportData.yaml", "configuration file of 'run <job>'")
+
+    queryDir := flag.String("queryDir", "", "batch mode: export every .sql file of the directory")
+    queryList := flag.String("queryList", "", "batch mode: file with query file names, one per line")
+    workers := flag.Int("workers", 4, "batch mode: number of queries exported at the same time")
+    schema := flag.String("schema", "", "schema mode: export every table of the schema")
+    include := flag.String("include", "", "schema mode: comma-separated LIKE patterns of table names to export")
+    exclude := flag.String("exclude", "", "schema mode: comma-separated LIKE patterns of table names to skip")
+    vars := Vars{}
+    flag.Var(vars, "var", "query template variable key=value, may be repeated")
+    snapshotScn := flag.String("snapshotScn", "", "value of :snapshot_scn bind, default current SCN")
+    watermarkColumn := flag.String("watermark", "", "incremental mode: high-water mark column of the query")
+    watermarkType := flag.String("watermarkType", "number", "incremental mode: type of the watermark column, number or timestamp")
+    stateFile := flag.String("stateFile", "", "incremental mode: state file, default <fname>.state")
+    sessionSql := flag.String("sessionSql", "", "file with statements run on every new session")
+    preSql := flag.String("preSql", "", "file with statements run before the export")
+    postSql := flag.String("postSql", "", "file with statements run after the export")
+    fetchArraySize := flag.Int("fetchArraySize", 0, "rows fetched in one round trip, default of the driver")
+    prefetchRows := flag.Int("prefetchRows", 0, "rows prefetched with the query execution, default of the driver")
+    lobPrefetch := flag.Bool("lobPrefetch", true, "fetch LOB values with the rows, otherwise read every LOB through its locator")
+    benchArraySizes := flag.String("benchArraySizes", "100,500,1000,5000", "bench mode: comma-separated list of fetch array sizes")
+    benchPrefetchRows := flag.String("benchPrefetchRows", "0", "bench mode: comma-separated list of prefetch rows")
+    formatWorkers := flag.Int("formatWorkers", 0, "goroutines formatting rows of each connection, 0 formats rows in the fetch goroutine")
+    ordered := flag.Bool("ordered", true, "keep the order of rows with format workers")
+    pipelineBuffer := flag.Int("pipelineBuffer", 4, "batches buffered between pipeline stages")
+    writers := flag.Int("writers", 1, "writer goroutines of each connection, every writer writes its own files")
+    stats := flag.Bool("stats", false, "print throughput and memory use of the pipeline stages")
+    progress := flag.String("progress", "off", "progress report: off, bar, log or auto (bar on a terminal)")
+    progressInterval := flag.Duration("progressInterval", 10 * time.Second, "interval of progress log lines")
+
+    // ExportData [run <job>] [flags]
+    if err := ParseFlags(flag.CommandLine, os.Args[1:]); err != nil {
+        Log(err)
+        os.Exit(2)
+    }
+
+    // A failed export exits with 1 after the deferred cleanup
+    exitCode := 0
+    defer func() {
+        if exitCode != 0 {
+            os.Exit(exitCode)
+        }
+    }()
+
+    // Streaming mode, keep stdout for the rows
+    streamName := *pipeName
+    if *toStdout {
+        streamName = "-"
+    }
+    if streamName != "" {
+        logOut = os.Stderr
+    }
+    // Streamed rows have no files to load
+    if streamName != "" && *sfConnStr != "" {
+        Log("-sfConn loads exported files, it is not supported with -stdout and -pipe")
+        return
+    }
+
+    // Secret provider
+    if *keyring != "" {
+        passphrase, err := ReadPassphrase()
+        if err != nil {
+            Log(err)
+            return
+        }
+        Secrets = &KeyringProvider{FileName: *keyring, Passphrase: passphrase}
+    } else if *secretExec != "" {
+        Secrets = &ExecProvider{Command: *secretExec}
+    }
+
+    // Store a secret
+    if *mode == "secret" {
+        if err := StoreSecret(Secrets, *secretName, *passwordStdin); err != nil {
+            Log(err)
+        }
+        return
+    }
+
+    // Batch mode
+    batch := *queryDir != "" || *queryList != ""
+    queryFiles := []string{}
+    if batch {
+        var err error
+        queryFiles, err = BatchQueryFiles(*queryDir, *queryList)
+        if err != nil {
+            Log(err)
+            return
+        }
+    }
+
+    // Tables of batch and schema exports are named after each query file or table
+    if (batch || *schema != "") && (*sfTable != "" || *ddlTable != "") {
+        Log("-sfTable and -ddlTable name one table, batch and schema exports use the name of each query file or table")
+        return
+    }
+
+    // Copy mode copies one query in the session of the export
+    if *mode == "copy" {
+        if batch || *schema != "" {
+            Log("Copy mode copies one query, -queryDir, -queryList and -schema are not supported")
+            return
+        }
+        if *rangeStart != "-" && *rangeEnd != "-" {
+            Log("Copy mode copies the whole query, -rangeStart and -rangeEnd are not supported")
+            return
+        }
+        // Masks apply to the text of files, copied values would be unmasked
+        if *mask != "" || *maskFile != "" {
+            Log("Copy mode inserts the values as they are, -mask and -maskFile are not supported")
+            return
+        }
+    }
 
     // Read query file
-    content, err := ioutil.ReadFile(*queryFileName)
+    var content []byte
+    var queryFile QueryFile
+    var err error
+    if !batch && *schema == "" {
+        content, err = ioutil.ReadFile(*queryFileName)
+        if err != nil {
+            Log(err)
+            return
+        }
+        rendered, err := RenderQuery(string(content), vars)
+        if err != nil {
+            Log(*queryFileName, err)
+            return
+        }
+        queryFile, err = ParseQueryFile(rendered)
+        if err != nil {
+            Log(*queryFileName, err)
+            return
+        }
+        content = []byte(queryFile.Query)
+    }
+
+    // Statements of companion files
+    hooks := QueryFile{}
+    if hooks.Session, err = ReadStatements(*sessionSql, vars); err != nil {
+        Log(*sessionSql, err)
+        return
+    }
+    if hooks.Pre, err = ReadStatements(*preSql, vars); err != nil {
+        Log(*preSql, err)
+        return
+    }
+    if hooks.Post, err = ReadStatements(*postSql, vars); err != nil {
+        Log(*postSql, err)
+        return
+    }
+    SessionStatements = append(SessionStatements, hooks.Session...)
+    SessionStatements = append(SessionStatements, queryFile.Session...)
+
+    // Init parameters
+    params := Params{ConnStr: *connStr, FileName: *fileName,
+                        Query: string(content), MaxSizeMB: *maxSizeMB, Compress: *compress,
+                    	DoubleQuotes: *doubleQuotes, TabSeparated: *tabSeparated,
+                        Manifest: &Manifest{},
+                        SfConnStr: *sfConnStr, SfStage: *sfStage, SfTable: *sfTable,
+                        TargetDriver: *targetDriver, TargetConnStr: *targetConnStr,
+                        TargetTable: *targetTable, InsertBatch: *insertBatch,
+                        DDLTable: *ddlTable, SfNumber: *sfNumber, Vars: vars,
+                        Binds: map[string]interface{}{}}
+    if *snapshotScn != "" {
+        params.Binds["snapshot_scn"] = *snapshotScn
+    }
+    params.FetchOptions = FetchOptions(*fetchArraySize, *prefetchRows, *lobPrefetch)
+    params.FormatWorkers = *formatWorkers
+    params.Ordered = *ordered
+    params.PipelineBuffer = *pipelineBuffer
+    params.Writers = *writers
+    params.TargetRows = *targetRows
+    params.TargetTime = *targetTime
+    params.MinBatch = *minBatch
+    params.MaxBatch = *maxBatch
+    params.RangeTimeout = *rangeTimeout
+    if params.FormatWorkers < 0 || params.PipelineBuffer < 0 {
+        Log("-formatWorkers and -pipelineBuffer can't be negative")
+        return
+    }
+    if params.Writers < 1 {
+        Log("-writers must be at least 1")
+        return
+    }
+    if params.SfNumber == "" {
+        Log("-sfNumber can't be empty")
+        return
+    }
+    params.Metrics = NewPipelineMetrics()
+    if *stats {
+        defer PrintPipelineMetrics(params.Metrics)
+    }
+    params.Progress = NewProgress()
+    if *progress != "off" && *progress != "bar" && *progress != "log" && *progress != "auto" {
+        Log("-progress must be off, bar, log or auto")
+        return
+    }
+
+    // Output format
+    params.Format, err = NewFormat(params, *delimiter, *quote, *escape, *null, *quoting, *lineEnd)
+    if err != nil {
+        Log(err)
+        return
+    }
+
+    params.Format.TimeLayouts, err = NewTimeLayouts(*dateFormat, *timestampFormat, *timestampTzFormat)
+    if err != nil {
+        Log(err)
+        return
+    }
+
+    if *timezone != "" {
+        params.Format.Location, err = time.LoadLocation(*timezone)
+        if err != nil {
+            Log(err)
+            return
+        }
+    }
+
+    if *numberFormat != "plain" && *numberFormat != "fixed" && *numberFormat != "scientific" {
+        Log("Unknown number format:", *numberFormat)
+        return
+    }
+    params.Format.Number = *numberFormat
+    params.Format.DecimalSep = *decimalSep
+
+    // Column masks
+    maskSpec := strings.Split(*mask, ",")
+    if *maskFile != "" {
+        content, err := ioutil.ReadFile(*maskFile)
+        if err != nil {
+            Log(err)
+            return
+        }
+        maskSpec = append(maskSpec, strings.Split(string(content), "\n")...)
+    }
+    params.Format.Masks, err = ParseMasks(maskSpec)
+    if err != nil {
+        Log(err)
+        return
+    }
+    params.Format.MaskSalt = []byte(*maskSalt)
+    if *maskSalt == "" {
+        params.Format.MaskSalt = []byte(os.Getenv("EXPORT_MASK_SALT"))
+    }
+    if err = CheckMaskSalt(params.Format.Masks, params.Format.MaskSalt); err != nil {
+        Log(err)
+        return
+    }
+
+    // Output encoding
+    params.Encoding = strings.ToLower(*encoding)
+    if params.Encoding == "latin1" {
+        params.Encoding = "iso-8859-1"
+    }
+    if _, ok := Charsets[params.Encoding]; !ok {
+        Log("Unknown encoding:", *encoding)
+        return
+    }
+    if *encodingErrors != "replace" && *encodingErrors != "strict" {
+        Log("Unknown encoding errors mode:", *encodingErrors)
+        return
+    }
+    params.EncodingStrict = *encodingErrors == "strict"
+    params.BOM = *bom
+
+    if params.SfConnStr != "" && Charsets[params.Encoding].Snowflake == "" {
+        Log("Snowflake does not load", params.Encoding)
+        return
+    }
+
+    if *ddl != "" {
+        params.DDL = strings.Split(*ddl, ",")
+        for _, dialect := range params.DDL {
+            if dialect != "oracle" && dialect != "snowflake" && dialect != "postgres" && dialect != "bigquery" {
+                Log("Unknown DDL dialect:", dialect)
+                return
+            }
+        }
+    }
+
+    if *loaders != "" {
+        params.Loaders = strings.Split(*loaders, ",")
+        for _, loader := range params.Loaders {
+            if loader != "sqlldr" && loader != "snowflake" && loader != "postgres" {
+                Log("Unknown loader:", loader)
+                return
+            }
+        }
+    }
+
+    // Check and read password
+    params.Credentials = Credentials{PasswordEnv: *passwordEnv, PasswordFile: *passwordFile,
+                                     PasswordStdin: *passwordStdin, External: *externalAuth}
+    params.ConnStr, err = ReadPassword(params.ConnStr, params.Credentials)
+
     if err != nil {
-        fmt.Println(err)
+        Log(err)
+        return
+    }
+
+    // Read range
+    ranged := *rangeStart != "-" && *rangeEnd != "-"
+    rs, re := 0, 0
+    if ranged {
+        rs, err = strconv.Atoi(*rangeStart)
+        if err != nil {
+            Log(err)
+            return
+        }
+        re, err = strconv.Atoi(*rangeEnd)
+        if err != nil {
+            Log(err)
+            return
+        }
+    }
+
+    // Progress of the export, after the parameters are checked and the password is read
+    if *progress != "off" {
+        params.Progress.Start(*progress, *progressInterval)
+        defer params.Progress.Stop()
+    }
+
+    // Session of an export without ranges: pre-export statements, the query and
+    // post-export statements share it, so rows of temporary tables are visible
+    var session *sql.Conn
+    if !batch && *schema == "" && !ranged && (*mode == "export" || *mode == "copy") {
+        db, conn, err := ExportSession(params.ConnStr)
+        if err != nil {
+            Log("... DB Setup Failed")
+            Log(err)
+            return
+        }
+        defer db.Close()
+        defer conn.Close()
+        session = conn
+    }
+
+    // Pre-export statements of the companion file, then of the query file
+    params.Pre = append(hooks.Pre, queryFile.Pre...)
+    params.Post = append(queryFile.Post, hooks.Post...)
+    if err = RunHooks(params, session, params.Pre, params.Binds); err != nil {
+        Log("... Pre-export statements failed")
+        Log(err)
+        return
+    }
+
+    // Snapshot SCN of all connections
+    if !batch && UsesBind(params.Query, "snapshot_scn") && params.Binds["snapshot_scn"] == nil {
+        if err = SnapshotSCN(params); err != nil {
+            Log(err)
+            return
+        }
+    }
+
+    // Fetch benchmark
+    if *mode == "bench" {
+        arraySizes, err := ParseInts(*benchArraySizes)
+        if err != nil {
+            Log(err)
+            return
+        }
+        prefetch, err := ParseInts(*benchPrefetchRows)
+        if err != nil {
+            Log(err)
+            return
+        }
+        PrintBenchSummary(BenchmarkFetch(params, arraySizes, prefetch, *lobPrefetch))
+        return
+    }
+
+    // Copy to table
+    if *mode == "copy" {
+        if err = CopyTable(session, params); err != nil {
+            Log("... Copy failed")
+            Log(err)
+            exitCode = 1
+            return
+        }
+        if err = RunHooks(params, session, params.Post, params.Binds); err != nil {
+            Log("... Post-export statements failed")
+            Log(err)
+        }
+        return
+    }
+
+    if batch {
+        if streamName != "" {
+            Log("Batch mode writes files, -stdout and -pipe are not supported")
+            return
+        }
+
+        results := RunBatch(params, queryFiles, *workers)
+        if PrintBatchSummary(results) > 0 {
+            exitCode = 1
+        }
+        if err = RunHooks(params, nil, hooks.Post, BatchBinds(params, results)); err != nil {
+            Log("... Post-export statements failed")
+            Log(err)
+        }
         return
     }
 
-    // Init parameters
-    params := Params{ConnStr: *connStr, FileName: *fileName,
-                        Query: string(content), MaxSizeMB: *maxSizeMB, Compress: *compress,
-                    	DoubleQuotes: *doubleQuotes, TabSeparated: *tabSeparated}
+    if *schema != "" {
+        if streamName != "" {
+            Log("Schema mode writes files, -stdout and -pipe are not supported")
+            return
+        }
+
+        results := ExportSchema(params, strings.ToUpper(*schema), SplitList(*include), SplitList(*exclude), *batchSize, *parallel)
+        if PrintBatchSummary(results) > 0 {
+            exitCode = 1
+        }
+        if err = RunHooks(params, nil, hooks.Post, BatchBinds(params, results)); err != nil {
+            Log("... Post-export statements failed")
+            Log(err)
+        }
+        return
+    }
+
+    // Generate file name
+    if params.FileName == "-" {
+        params.FileName = TrimExtension(*queryFileName)
+    }
+
+    // Incremental export
+    var watermark *Watermark
+    stateFileName := *stateFile
+    if *watermarkColumn != "" {
+        if streamName != "" {
+            Log("Incremental mode writes files, -stdout and -pipe are not supported")
+            return
+        }
+        if stateFileName == "" {
+            stateFileName = params.FileName + ".state"
+        }
+
+        binds := map[string]interface{}{}
+        if ranged {
+            binds["range_start"] = rs
+            binds["range_end"] = re
+        }
+        watermark, err = StartIncremental(&params, *watermarkColumn, *watermarkType, stateFileName, binds)
+        if err != nil {
+            Log(err)
+            return
+        }
+        if watermark == nil {
+            Log("... No new rows")
+            return
+        }
+    }
+
+    // Open stream
+    if streamName != "" {
+        params.Stream, err = OpenStream(streamName, params.Compress, NewEncoder(params).BOMBytes(params.BOM))
+        if err != nil {
+            Log(err)
+            return
+        }
+    }
+
+    if ranged {
+        RunUnloadTableByRange(params, rs, re, *batchSize, *parallel)
+    } else {
+        UnloadQuery(session, params)
+    }
+
+    // The last rows of the stream are written on close
+    if params.Stream != nil {
+        if err = params.Stream.Close(); err != nil {
+            params.Manifest.Fail(err)
+        }
+    }
+
+    if err = FinishExport(params); err != nil {
+        Log(err)
+        exitCode = 1
+        return
+    }
+
+    // The watermark advances only after all files are closed
+    if watermark != nil {
+        for _, ef := range params.Manifest.Files {
+            watermark.Files = append(watermark.Files, ef.Name)
+        }
+        if err = SaveWatermark(stateFileName, watermark); err != nil {
+            Log(err)
+            return
+        }
+        Log("... Watermark", watermark.Value)
+    }
+
+    // Post-export statements
+    if err = RunHooks(params, session, params.Post, ExportBinds(params)); err != nil {
+        Log("... Post-export statements failed")
+        Log(err)
+    }
+}
+
+// FinishExport writes the manifest and loader files and loads files to Snowflake
+func FinishExport(params Params) error {
+    if params.Manifest.Replaced > 0 {
+        Log("...", params.Manifest.Replaced, "characters replaced, not representable in", params.Encoding)
+    }
+
+    if params.Stream != nil {
+        return params.Manifest.Err()
+    }
+
+    // A failed export has no manifest, the manifest of an earlier run is removed
+    if err := params.Manifest.Err(); err != nil {
+        Log("... Export failed, no manifest is written and files are not loaded")
+        os.Remove(params.FileName + ".manifest")
+        return err
+    }
+
+    // Write manifest
+    if err := params.Manifest.Write(params.FileName + ".manifest"); err != nil {
+        return err
+    }
+
+    // Write loader files
+    WriteLoaders(params)
+
+    // Load to Snowflake
+    if params.SfConnStr != "" {
+        if err := LoadToSnowflake(params, params.Manifest.Files); err != nil {
+            Log("... Snowflake load failed")
+            return err
+        }
+    }
+
+    return nil
+}
+
+// ReadPassword adds the password to a connection string without one. The password is
+// taken from an environment variable, a file, stdin or the terminal, in this order.
+// External authentication (/@tns, Oracle Wallet) and logfmt strings are used as is
+func ReadPassword(connStr string, creds Credentials) (string, error) {
+    // Secrets are resolved on connect, only checked here
+    resolved, err := ResolveConnSecrets(connStr)
+    if err != nil {
+        return "", err
+    }
+
+    user, password, dsn, hasPassword := ParseConnStr(resolved)
+    if hasPassword || strings.Contains(connStr, "password=") {
+        return connStr, nil
+    }
+    user, _, dsn, _ = ParseConnStr(connStr)
+
+    // External authentication
+    if strings.HasPrefix(connStr, "/@") || creds.External {
+        return connStr, nil
+    }
+
+    switch {
+    case creds.PasswordEnv != "":
+        value, ok := os.LookupEnv(creds.PasswordEnv)
+        if !ok {
+            return "", fmt.Errorf("Environment variable %s is not set", creds.PasswordEnv)
+        }
+        password = value
+
+    case creds.PasswordFile != "":
+        value, err := ReadPasswordFile(creds.PasswordFile)
+        if err != nil {
+            return "", err
+        }
+        password = value
+
+    case creds.PasswordStdin:
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && err != io.EOF {
+            return "", err
+        }
+        password = strings.TrimRight(line, "\r\n")
+
+    default:
+        if !terminal.IsTerminal(int(syscall.Stdin)) {
+            return "", fmt.Errorf("No password in the connection string and stdin is not a terminal, use -passwordEnv, -passwordFile or -passwordStdin")
+        }
+
+        fmt.Fprint(logOut, "Enter password: ")
+        bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+        if err != nil {
+            return "", err
+        }
+        Log()
+        password = string(bytePassword)
+    }
+
+    return BuildConnStr(user, password, dsn), nil
+}
+
+// ParseConnStr splits user/password@dsn: the dsn is after the last '@',
+// the user is before the first '/', so the password may contain '@' and '/'
+func ParseConnStr(connStr string) (user string, password string, dsn string, hasPassword bool) {
+    creds := connStr
+    if i := strings.LastIndex(connStr, "@"); i >= 0 {
+        creds, dsn = connStr[:i], connStr[i + 1:]
+    }
+
+    if i := strings.Index(creds, "/"); i >= 0 {
+        return creds[:i], strings.Trim(creds[i + 1:], "\""), dsn, true
+    }
+    return creds, "", dsn, false
+}
+
+// BuildConnStr quotes a password with special characters, without dsn there is no '@'
+func BuildConnStr(user string, password string, dsn string) string {
+    if strings.ContainsAny(password, "@/ ") {
+        password = "\"" + password + "\""
+    }
+    if dsn == "" {
+        return user + "/" + password
+    }
+    return user + "/" + password + "@" + dsn
+}
+
+// ReadPasswordFile reads the first line of a file readable by the owner only
+func ReadPasswordFile(fileName string) (string, error) {
+    fi, err := os.Stat(fileName)
+    if err != nil {
+        return "", err
+    }
+    if fi.Mode().Perm() & 0077 != 0 {
+        return "", fmt.Errorf("Password file %s is accessible by others (%o), expected 0600", fileName, fi.Mode().Perm())
+    }
+
+    content, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return "", err
+    }
+
+    return strings.TrimRight(strings.SplitN(string(content), "\n", 2)[0], "\r"), nil
+}
+
+func NullTimeToString(v sql.NullTime, columnType string, format Format) string {
+    if !v.Valid {
+        return ""
+    }
+
+    layout, ok := format.TimeLayouts[columnType]
+    if !ok {
+        return ""
+    }
+
+    t := v.Time
+    if format.Location != nil && (columnType == "TIMESTAMP WITH TIME ZONE" || columnType == "TIMESTAMP WITH LOCAL TIME ZONE") {
+        t = t.In(format.Location)
+    }
+
+    switch layout {
+    case "epoch":
+        return strconv.FormatInt(t.Unix(), 10)
+    case "epochms":
+        return strconv.FormatInt(t.UnixNano() / int64(time.Millisecond), 10)
+    }
+    return t.Format(layout)
+}
+
+// Layouts of the presets by Oracle type
+var timePresets = map[string]map[string]string{
+    "iso8601": {
+        "DATE":                             "2006-01-02T15:04:05",
+        "TIMESTAMP":                        "2006-01-02T15:04:05.000000000",
+        "TIMESTAMP WITH TIME ZONE":         "2006-01-02T15:04:05.000000000-07:00",
+        "TIMESTAMP WITH LOCAL TIME ZONE":   "2006-01-02T15:04:05.000000000",
+    },
+    "rfc3339": {
+        "DATE":                             time.RFC3339,
+        "TIMESTAMP":                        time.RFC3339Nano,
+        "TIMESTAMP WITH TIME ZONE":         time.RFC3339Nano,
+        "TIMESTAMP WITH LOCAL TIME ZONE":   time.RFC3339Nano,
+    },
+}
+
+// strftime directives as Go layouts
+var strftimeDirectives = map[byte]string{
+    'Y': "2006", 'y': "06", 'm': "01", 'd': "02", 'H': "15", 'I': "03", 'M': "04", 'S': "05",
+    'p': "PM", 'b': "Jan", 'B': "January", 'a': "Mon", 'A': "Monday", 'j': "002",
+    'f': "000000", 'N': "000000000", 'z': "-0700", 'Z': "MST", '%': "%",
+}
+
+func StrftimeToLayout(format string) (string, error) {
+    var b strings.Builder
+
+    for i := 0; i < len(format); i++ {
+        if format[i] != '%' {
+            b.WriteByte(format[i])
+            continue
+        }
+
+        i++
+        if i == len(format) {
+            return "", fmt.Errorf("Wrong strftime format: %s", format)
+        }
+        layout, ok := strftimeDirectives[format[i]]
+        if !ok {
+            return "", fmt.Errorf("Unsupported strftime directive %%%c in %s", format[i], format)
+        }
+        b.WriteString(layout)
+    }
+
+    return b.String(), nil
+}
+
+// NewTimeLayouts applies the date time format flags to the default TimeLayouts
+func NewTimeLayouts(dateFormat string, timestampFormat string, timestampTzFormat string) (map[string]string, error) {
+    layouts := map[string]string{}
+    for k, v := range TimeLayouts {
+        layouts[k] = v
+    }
+
+    formats := map[string]string{
+        "DATE":                             dateFormat,
+        "TIMESTAMP":                        timestampFormat,
+        "TIMESTAMP WITH TIME ZONE":         timestampTzFormat,
+        "TIMESTAMP WITH LOCAL TIME ZONE":   timestampFormat,
+    }
+
+    for columnType, format := range formats {
+        if format == "" {
+            continue
+        }
+
+        switch preset := strings.ToLower(format); {
+        case preset == "epoch" || preset == "epochms":
+            layouts[columnType] = preset
+        case timePresets[preset] != nil:
+            layouts[columnType] = timePresets[preset][columnType]
+        case strings.Contains(format, "%"):
+            layout, err := StrftimeToLayout(format)
+            if err != nil {
+                return nil, err
+            }
+            layouts[columnType] = layout
+        default:
+            layouts[columnType] = format
+        }
+    }
+
+    return layouts, nil
+}
+
+func DefineColumnTypes(rows *sql.Rows, format Format) (columnTypes []*sql.ColumnType, row []interface{}, formatters []Formatter, err error) {
+    columnTypes, err = rows.ColumnTypes()
+    if err != nil {
+    	return
+    }
+
+    row, err = NewScanRow(columnTypes)
+    if err != nil {
+        return
+    }
+
+    masks := format.ColumnMasks(columnTypes)
+    for i, c := range columnTypes {
+        formatters = append(formatters, format.NewFormatter(c, row[i], masks[i]))
+    }
+
+    return
+}
+
+// NewScanRow returns scan values of the column types
+func NewScanRow(columnTypes []*sql.ColumnType) (row []interface{}, err error) {
+    for _, c := range columnTypes {
+        if c.DatabaseTypeName() == "NUMBER" {
+            //row = append(row, &sql.NullFloat64{0, false})
+            row = append(row, &sql.NullString{"", false})
+        } else if c.DatabaseTypeName() == "VARCHAR2" || c.DatabaseTypeName() == "NVARCHAR2" || c.DatabaseTypeName() == "CHAR" || c.DatabaseTypeName() == "NCHAR" {
+            row = append(row, &sql.NullString{"", false})
+        } else if c.DatabaseTypeName() == "CLOB" || c.DatabaseTypeName() == "NCLOB" {
+            row = append(row, &LobString{})
+        } else if c.DatabaseTypeName() == "DATE" || c.DatabaseTypeName() == "TIMESTAMP" || c.DatabaseTypeName() == "TIMESTAMP WITH TIME ZONE" || c.DatabaseTypeName() == "TIMESTAMP WITH LOCAL TIME ZONE" {
+            row = append(row, &sql.NullTime {time.Time{}, false})
+        } else {
+        	return nil, fmt.Errorf("Unexpected type: %s ", c.DatabaseTypeName())
+        }
+    }
+
+    return row, nil
+}
+
+// ExportSession connects and takes the session of an export without ranges
+func ExportSession(connStr string) (*sql.DB, *sql.Conn, error) {
+    Log("... Setting up Database Connection")
+    db, err := ConnectToDB(connStr)
+    if err != nil {
+        return nil, nil, err
+    }
+
+    conn, err := SessionConn(context.Background(), db, nil)
+    if err != nil {
+        db.Close()
+        return nil, nil, err
+    }
+    return db, conn, nil
+}
+
+// UnloadQuery exports the query of params through a connection pool or a single connection
+func UnloadQuery(q Queryer, params Params) {
+    // Exec query
+    rows, err := q.QueryContext(context.Background(), params.Query, append(QueryArgs(params.Query, params.Binds), params.FetchOptions...)...)
+    if err != nil {
+        Log("... Error processing query")
+        Log(err)
+        params.Manifest.Fail(err)
+        return
+    }
+
+    // Define column types
+    columnTypes, row, formatters, err := DefineColumnTypes(rows, params.Format)
+    if err != nil {
+        Log("... Error defining column types")
+        Log(err)
+        params.Manifest.Fail(err)
+        return
+    }
+    if params.Manifest.SetColumnTypes(columnTypes) {
+        WriteDDL(params, columnTypes)
+    }
+
+    // Format and write to file
+    p := StartPipeline(0, params)
+    defer p.Close()
+
+    // Fetch rows
+    if _, err = p.Fetch(rows, columnTypes, row, formatters); err != nil {
+        Log("... Error fetching rows")
+        Log(err)
+        params.Manifest.Fail(err)
+    }
+
+    rows.Close()
+}
+
+func RunUnloadTableByRange(params Params, rangeStart int, rangeEnd int, batchSize int, parallel int) {
+    var w sync.WaitGroup
+    w.Add(parallel)
+    defer w.Wait()
+
+    // Make error channel
+    cError := make(chan error)
+    defer close(cError)
+
+    // Make range channel
+    cRange := make(chan Range)
+    defer close(cRange)
+
+    // Make result channel, a worker sends at most one result after the last range is sent
+    cResult := make(chan RangeResult, parallel)
+
+    for p := 1; p <= parallel; p++ {
+        go func(rId int, params Params, ciRange <- chan Range, coResult chan <- RangeResult, coError chan <- error) {
+            UnloadTableByRange(rId, params, ciRange, coResult, coError)
+            w.Done()
+        }(p, params, cRange, cResult, cError)
+    }
+
+    // Check errors
+    errors := []error{}
+    for p := 1; p <= parallel; p++ {
+        err := <- cError
+        if err != nil {
+            errors = append(errors, err)
+        }
+    }
+    if len(errors) > 0 {
+        for _, err := range errors {
+            Log(err)
+            params.Manifest.Fail(err)
+        }
+        return
+    }
+
+    // Generation of ranges, the width of the next range follows the results of the workers
+    sizer := NewRangeSizer(params)
+    width := sizer.Clamp(batchSize)
+    next := rangeStart
+    retry := []Range{}
+    running := 0
+
+    // Planned ranges for the progress, done ranges and the rest with the current width
+    done, planned := 0, 0
+    plan := func() {
+        n := done + running + len(retry)
+        if next <= rangeEnd {
+            n += (rangeEnd - next) / width + 1
+        }
+        params.Progress.Plan(0, int64(n - planned))
+        planned = n
+    }
+    params.Progress.Plan(int64(rangeEnd - rangeStart + 1), 0)
+    plan()
+
+    for next <= rangeEnd || len(retry) > 0 || running > 0 {
+        // Timed out ranges first
+        var coRange chan <- Range
+        var r Range
+        if len(retry) > 0 {
+            coRange, r = cRange, retry[0]
+        } else if next <= rangeEnd {
+            l := next + width - 1;
+            if l > rangeEnd || l < next {
+                l = rangeEnd;
+            }
+            coRange, r = cRange, Range{next, l}
+        }
+
+        select {
+        case coRange <- r:
+            running++
+            if len(retry) > 0 {
+                retry = retry[1:]
+            } else {
+                next = r.LastValue + 1
+            }
+        case res := <- cResult:
+            running--
+            if res.Err != nil {
+                return
+            }
+
+            if res.Timeout {
+                if res.Range.FirstValue == res.Range.LastValue {
+                    params.Manifest.Fail(fmt.Errorf("Range %d timed out after %s", res.Range.FirstValue, params.RangeTimeout))
+                    return
+                }
+                // Split the range
+                m := res.Range.FirstValue + (res.Range.LastValue - res.Range.FirstValue) / 2
+                retry = append(retry, Range{res.Range.FirstValue, m}, Range{m + 1, res.Range.LastValue})
+            }
+
+            if !res.Timeout {
+                done++
+            }
+            if resized := sizer.Next(width, res); resized != width {
+                Log("... batch", resized)
+                width = resized
+            }
+            plan()
+        }
+    }
+}
+
+func UnloadTableByRange(rId int, params Params, ciRange <- chan Range, coResult chan <- RangeResult, coError chan <- error) {
+    Log(rId, "... Setting up Database Connection")
+    db, err := ConnectToDB(params.ConnStr)
+    if err != nil {
+        coError <- err
+        return
+    }
+    defer db.Close()
+
+    // Session of the worker, a pooled connection would miss the session statements
+    session, err := SessionConn(context.Background(), db, nil)
+    if err != nil {
+        coError <- err
+        return
+    }
+    defer func() { session.Close() }()
+
+    // Error - Ok
+    coError <- nil
+
+    // Format and write to file
+    p := StartPipeline(rId, params)
+    defer p.Close()
+
+    // Get range
+    for r := range ciRange {
+        Log(rId, "range", r.FirstValue, r.LastValue)
+        start := time.Now()
+
+        // Exec query
+        rows, cancel, err := QueryRange(session, params, r)
+        if err == context.DeadlineExceeded {
+            Log(rId, "... Range timed out after", params.RangeTimeout)
+
+            // The cancelled session may be broken, the next range runs in a new one
+            session.Close()
+            if session, err = SessionConn(context.Background(), db, nil); err != nil {
+                Log(rId, "... Error setting up session", err)
+                params.Manifest.Fail(err)
+                coResult <- RangeResult{Range: r, Err: err}
+                return
+            }
+            coResult <- RangeResult{Range: r, Duration: time.Since(start), Timeout: true}
+            continue
+        }
+        if err != nil {
+            Log(rId, "... Error processing query", err)
+            params.Manifest.Fail(err)
+            coResult <- RangeResult{Range: r, Err: err}
+            return
+        }
+
+        // Define column types
+	    columnTypes, row, formatters, err := DefineColumnTypes(rows, params.Format)
+	    if err != nil {
+	    	Log(rId, "... Error defining column types", err)
+	    	params.Manifest.Fail(err)
+            rows.Close()
+            cancel()
+            coResult <- RangeResult{Range: r, Err: err}
+	        return
+	    }
+        if params.Manifest.SetColumnTypes(columnTypes) {
+            WriteDDL(params, columnTypes)
+        }
+
+        // Fetch rows
+        n, err := p.Fetch(rows, columnTypes, row, formatters)
+        rows.Close()
+        cancel()
+        if err != nil {
+            Log(rId, "... Error fetching rows", err)
+            params.Manifest.Fail(err)
+            coResult <- RangeResult{Range: r, Err: err}
+            return
+        }
+        params.Progress.RangeDone(rId, r, time.Since(start))
+        coResult <- RangeResult{Range: r, Rows: n, Duration: time.Since(start)}
+    }
+
+    Log(rId, "... Closing connection")
+}
+
+// QueryRange executes the query of a range. With RangeTimeout the execution is cancelled
+// after the timeout and context.DeadlineExceeded is returned, fetching rows is not limited.
+// The caller calls cancel after the rows are closed
+func QueryRange(q Queryer, params Params, r Range) (*sql.Rows, context.CancelFunc, error) {
+    args := append(RangeArgs(params, r), params.FetchOptions...)
+    ctx, cancel := context.WithCancel(context.Background())
+    if params.RangeTimeout <= 0 {
+        rows, err := q.QueryContext(ctx, params.Query, args...)
+        if err != nil {
+            cancel()
+            return nil, nil, err
+        }
+        return rows, cancel, nil
+    }
+
+    timer := time.AfterFunc(params.RangeTimeout, cancel)
+    rows, err := q.QueryContext(ctx, params.Query, args...)
+
+    // Timer already fired
+    if !timer.Stop() {
+        if err == nil {
+            rows.Close()
+        }
+        cancel()
+        return nil, nil, context.DeadlineExceeded
+    }
+    if err != nil {
+        cancel()
+        return nil, nil, err
+    }
+    return rows, cancel, nil
+}
+
+func NewRangeSizer(params Params) *RangeSizer {
+    return &RangeSizer{TargetRows: params.TargetRows, TargetTime: params.TargetTime,
+                       MinWidth: params.MinBatch, MaxWidth: params.MaxBatch}
+}
+
+// Next returns the width of the next range after the result of a range. A timed out range
+// halves the width, otherwise the width aims at the targets with the rows and time per key
+// of a moving average: the values of the range are averaged with the previous estimate, so
+// every older range has half the weight of the next one. The width grows at most 4 times per range
+func (s *RangeSizer) Next(width int, res RangeResult) int {
+    keys := float64(res.Range.LastValue - res.Range.FirstValue + 1)
+
+    if res.Timeout {
+        half := int(keys / 2)
+        if half < width {
+            width = half
+        }
+        return s.Clamp(width)
+    }
+
+    if s.TargetRows <= 0 && s.TargetTime <= 0 {
+        return width
+    }
+
+    rowsPerKey := float64(res.Rows) / keys
+    timePerKey := float64(res.Duration) / keys
+    if s.ranges == 0 {
+        s.rowsPerKey, s.timePerKey = rowsPerKey, timePerKey
+    } else {
+        s.rowsPerKey = (s.rowsPerKey + rowsPerKey) / 2
+        s.timePerKey = (s.timePerKey + timePerKey) / 2
+    }
+    s.ranges++
+
+    target := float64(width) * 4
+    if s.TargetRows > 0 && s.rowsPerKey > 0 && float64(s.TargetRows) / s.rowsPerKey < target {
+        target = float64(s.TargetRows) / s.rowsPerKey
+    }
+    if s.TargetTime > 0 && s.timePerKey > 0 && float64(s.TargetTime) / s.timePerKey < target {
+        target = float64(s.TargetTime) / s.timePerKey
+    }
+    if target > float64(MaxRangeWidth) {
+        target = float64(MaxRangeWidth)
+    }
+    return s.Clamp(int(target))
+}
+
+// Clamp limits the width to MinWidth and MaxWidth, 0 is no limit
+func (s *RangeSizer) Clamp(width int) int {
+    if s.MaxWidth > 0 && width > s.MaxWidth {
+        width = s.MaxWidth
+    }
+    if width < s.MinWidth {
+        width = s.MinWidth
+    }
+    if width < 1 {
+        width = 1
+    }
+    return width
+}
+
+// ConnectToDB opens the pool, sessions of queries are set up by SessionConn
+func ConnectToDB(connStr string) (db *sql.DB, err error) {
+    connStr, err = ResolveConnSecrets(connStr)
+    if err != nil {
+        return nil, err
+    }
+
+    // Connect
+    db, err = sql.Open("godror", connStr)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = db.Ping(); err != nil {
+        return nil, err
+    }
+
+    return db, nil
+}
+
+// SessionConn takes a connection of the pool and sets up its session
+// with SessionStatements and the statements of the query file
+func SessionConn(ctx context.Context, db *sql.DB, statements []string) (*sql.Conn, error) {
+    conn, err := db.Conn(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, stmt := range append(SessionStatements[:len(SessionStatements):len(SessionStatements)], statements...) {
+        if _, err = conn.ExecContext(ctx, stmt); err != nil {
+            conn.Close()
+            return nil, err
+        }
+    }
+
+    return conn, nil
+}
+
+// FetchRows formats rows into batches of lines in the fetch goroutine, the writer releases the batches.
+// seq is the sequence number of the first batch, returns the next one, the number of rows and
+// the error of a scan or of the fetch, the rows before the error are passed to the writer
+func FetchRows(rows *sql.Rows, row []interface{}, formatters []Formatter, format Format, metrics *PipelineMetrics, seq int, coRows chan <- *RowBatch) (int, int, error) {
+    batch := NewRowBatch()
+    start := time.Now()
+    n := 0
+
+    send := func() {
+        batch.Seq = seq
+        seq++
+        metrics.Fetch.Record(batch.Rows, len(batch.Lines), start)
+        metrics.Write.Queue(len(coRows))
+        coRows <- batch
+    }
+
+    var err error
+    for rows.Next() {
+        if err = rows.Scan(row...); err != nil {
+            break
+        }
+
+        batch.Lines = format.AppendRow(batch.Lines, formatters, row)
+        batch.Rows++
+        n++
+
+        if batch.Rows >= BatchRows || len(batch.Lines) >= BatchBytes {
+            send()
+            batch = NewRowBatch()
+            start = time.Now()
+        }
+    }
+    if err == nil {
+        err = rows.Err()
+    }
+
+    if batch.Rows > 0 {
+        send()
+    } else {
+        batch.Release()
+    }
+    return seq, n, err
+}
+
+func NewRowBatch() *RowBatch {
+    batch := batchPool.Get().(*RowBatch)
+    batch.Lines = batch.Lines[:0]
+    batch.Rows = 0
+    return batch
+}
+
+func (b *RowBatch) Release() {
+    batchPool.Put(b)
+}
+
+func NewFormat(params Params, delimiter string, quote string, escape string, null string, quoting string, lineEnd string) (Format, error) {
+    f := Format{Sep: ",", Quote: quote, Escape: escape, Null: null, Quoting: quoting, LineEnd: "\n"}
+
+    if params.TabSeparated {
+        f.Sep = "\t"
+    }
+    if delimiter != "" {
+        sep, err := strconv.Unquote("\"" + delimiter + "\"")
+        if err != nil {
+            return f, fmt.Errorf("Wrong delimiter: %s", delimiter)
+        }
+        f.Sep = sep
+    }
+
+    switch strings.ToUpper(lineEnd) {
+    case "LF":
+    case "CRLF":
+        f.LineEnd = "\r\n"
+    default:
+        return f, fmt.Errorf("Unknown line terminator: %s", lineEnd)
+    }
+
+    if f.Quoting == "" {
+        f.Quoting = "minimal"
+        if params.DoubleQuotes {
+            f.Quoting = "text"
+        }
+    }
+    if f.Quote == "" {
+        f.Quoting = "none"
+    }
+    if f.Quoting != "text" && f.Quoting != "all" && f.Quoting != "minimal" && f.Quoting != "none" {
+        return f, fmt.Errorf("Unknown quote policy: %s", f.Quoting)
+    }
+
+    if f.Escape != "double" && f.Escape != "backslash" {
+        return f, fmt.Errorf("Unknown escape style: %s", f.Escape)
+    }
+
+    // Unquoted values escape the separator and line breaks
+    if f.Escape == "backslash" {
+        pairs := []string{"\\", "\\\\", "\n", "\\n", "\r", "\\r", "\t", "\\t"}
+        if f.Sep != "\t" {
+            pairs = append(pairs, f.Sep, "\\" + f.Sep)
+        }
+        f.escaper = strings.NewReplacer(pairs...)
+    }
+
+    return f, nil
+}
+
+// QuoteType checks if the quote policy always quotes values of the type
+func (f Format) QuoteType(typeName string) bool {
+    return f.Quoting == "all" || (f.Quoting == "text" && typeName != "NUMBER")
+}
+
+// AppendField appends the value quoted by the quote policy; in every policy except none a value
+// containing the separator, the quote, CR or LF, or equal to the NULL token, is quoted.
+// quote is the result of QuoteType
+func (f Format) AppendField(buf []byte, s string, quote bool) []byte {
+    if f.Quoting == "none" {
+        if f.escaper != nil {
+            return append(buf, f.escaper.Replace(s)...)
+        }
+        return append(buf, s...)
+    }
+
+    if !quote && !f.NeedsQuote(s) {
+        return append(buf, s...)
+    }
+
+    escaped := f.Quote + f.Quote
+    if f.Escape == "backslash" {
+        s = strings.ReplaceAll(s, "\\", "\\\\")
+        escaped = "\\" + f.Quote
+    }
+
+    buf = append(buf, f.Quote...)
+    for {
+        i := strings.Index(s, f.Quote)
+        if i < 0 {
+            break
+        }
+        buf = append(buf, s[:i]...)
+        buf = append(buf, escaped...)
+        s = s[i + len(f.Quote):]
+    }
+    buf = append(buf, s...)
+    return append(buf, f.Quote...)
+}
+
+// AppendRow appends the fields of the scanned row and the line terminator
+func (f Format) AppendRow(buf []byte, formatters []Formatter, row []interface{}) []byte {
+    for i, formatter := range formatters {
+        if i > 0 {
+            buf = append(buf, f.Sep...)
+        }
+        buf = formatter(buf, row[i])
+    }
+    return append(buf, f.LineEnd...)
+}
+
+// NewFormatter resolves the formatter of a column by its scan value: NULL is the NULL token,
+// NUMBER values are formatted as text, then the mask is applied and the value is quoted
+func (f Format) NewFormatter(c *sql.ColumnType, value interface{}, mask *Mask) Formatter {
+    typeName := c.DatabaseTypeName()
+    quote := f.QuoteType(typeName)
+
+    field := func(buf []byte, s string) []byte {
+        if mask != nil {
+            s = mask.Apply(s, f.MaskSalt)
+        }
+        return f.AppendField(buf, s, quote)
+    }
+
+    switch value.(type) {
+    case *sql.NullString:
+        if typeName == "NUMBER" {
+            return func(buf []byte, value interface{}) []byte {
+                v := value.(*sql.NullString)
+                if !v.Valid {
+                    return append(buf, f.Null...)
+                }
+                return field(buf, f.FormatNumber(v.String, c))
+            }
+        }
+        return func(buf []byte, value interface{}) []byte {
+            v := value.(*sql.NullString)
+            if !v.Valid {
+                return append(buf, f.Null...)
+            }
+            return field(buf, v.String)
+        }
+    case *LobString:
+        return func(buf []byte, value interface{}) []byte {
+            v := value.(*LobString)
+            if !v.Valid {
+                return append(buf, f.Null...)
+            }
+            return field(buf, v.String)
+        }
+    case *sql.NullTime:
+        return func(buf []byte, value interface{}) []byte {
+            v := value.(*sql.NullTime)
+            if !v.Valid {
+                return append(buf, f.Null...)
+            }
+            return field(buf, NullTimeToString(*v, typeName, f))
+        }
+    }
+
+    return func(buf []byte, value interface{}) []byte {
+        return append(buf, f.Null...)
+    }
+}
+
+func (f Format) NeedsQuote(s string) bool {
+    return s == f.Null || strings.Contains(s, f.Sep) || strings.Contains(s, f.Quote) ||
+        strings.ContainsAny(s, "\r\n") || (f.Escape == "backslash" && strings.Contains(s, "\\"))
+}
+
+// FormatNumber renders NUMBER text of the driver exactly, without float conversion:
+// plain, fixed (scale of the column) or scientific
+func (f Format) FormatNumber(s string, c *sql.ColumnType) string {
+    d, ok := ParseDecimal(s)
+    if !ok {
+        return s
+    }
+
+    switch f.Number {
+    case "scientific":
+        return d.Scientific(f.DecimalSep)
+    case "fixed":
+        if precision, scale, ok := c.DecimalSize(); ok && precision > 0 && scale >= 0 {
+            return d.Fixed(int(scale), f.DecimalSep)
+        }
+    }
+    return d.Plain(f.DecimalSep)
+}
+
+// ParseDecimal reads numbers like -123.45, .5, 1E+125
+func ParseDecimal(s string) (Decimal, bool) {
+    neg := false
+    if strings.HasPrefix(s, "-") {
+        neg = true
+        s = s[1:]
+    } else if strings.HasPrefix(s, "+") {
+        s = s[1:]
+    }
+
+    exp := 0
+    if i := strings.IndexAny(s, "eE"); i >= 0 {
+        e, err := strconv.Atoi(s[i + 1:])
+        if err != nil {
+            return Decimal{}, false
+        }
+        exp = e
+        s = s[:i]
+    }
+
+    intPart, fracPart := s, ""
+    if i := strings.IndexByte(s, '.'); i >= 0 {
+        intPart, fracPart = s[:i], s[i + 1:]
+    }
+
+    digits := intPart + fracPart
+    if digits == "" || strings.Trim(digits, "0123456789") != "" {
+        return Decimal{}, false
+    }
+
+    return NewDecimal(neg, digits, exp - len(fracPart)), true
+}
+
+func NewDecimal(neg bool, digits string, exp int) Decimal {
+    digits = strings.TrimLeft(digits, "0")
+    if digits == "" {
+        return Decimal{}
+    }
+
+    trimmed := strings.TrimRight(digits, "0")
+    return Decimal{neg, trimmed, exp + len(digits) - len(trimmed)}
+}
+
+// Round rounds half away from zero to scale digits after the point
+func (d Decimal) Round(scale int) Decimal {
+    drop := -scale - d.Exp
+    if drop <= 0 {
+        return d
+    }
+    if drop > len(d.Digits) {
+        return Decimal{}
+    }
+
+    kept := []byte(d.Digits[:len(d.Digits) - drop])
+    if d.Digits[len(d.Digits) - drop] >= '5' {
+        i := len(kept) - 1
+        for ; i >= 0 && kept[i] == '9'; i-- {
+            kept[i] = '0'
+        }
+        if i < 0 {
+            kept = append([]byte{'1'}, kept...)
+        } else {
+            kept[i]++
+        }
+    }
+
+    return NewDecimal(d.Neg, string(kept), d.Exp + drop)
+}
+
+func (d Decimal) sign() string {
+    if d.Neg && d.Digits != "" {
+        return "-"
+    }
+    return ""
+}
+
+func (d Decimal) Plain(sep string) string {
+    if d.Digits == "" {
+        return "0"
+    }
+    if d.Exp >= 0 {
+        return d.sign() + d.Digits + strings.Repeat("0", d.Exp)
+    }
+
+    point := len(d.Digits) + d.Exp
+    if point > 0 {
+        return d.sign() + d.Digits[:point] + sep + d.Digits[point:]
+    }
+    return d.sign() + "0" + sep + strings.Repeat("0", -point) + d.Digits
+}
+
+// Fixed has exactly scale digits after the point
+func (d Decimal) Fixed(scale int, sep string) string {
+    r := d.Round(scale)
+
+    coeff := "0"
+    if r.Digits != "" {
+        coeff = r.Digits + strings.Repeat("0", r.Exp + scale)
+    }
+    if scale == 0 {
+        return r.sign() + coeff
+    }
+    if len(coeff) <= scale {
+        coeff = strings.Repeat("0", scale - len(coeff) + 1) + coeff
+    }
+
+    return r.sign() + coeff[:len(coeff) - scale] + sep + coeff[len(coeff) - scale:]
+}
+
+// Scientific is d.dddE+nn with all significant digits
+func (d Decimal) Scientific(sep string) string {
+    if d.Digits == "" {
+        return "0E+00"
+    }
+
+    mantissa := d.Digits[:1]
+    if len(d.Digits) > 1 {
+        mantissa += sep + d.Digits[1:]
+    }
+    return fmt.Sprintf("%s%sE%+03d", d.sign(), mantissa, d.Exp + len(d.Digits) - 1)
+}
+
+func (f Format) Extension() string {
+    switch f.Sep {
+    case ",":
+        return "csv"
+    case "\t":
+        return "tsv"
+    }
+    return "txt"
+}
+
+func TrimExtension(fileName string) string {
+    extension := filepath.Ext(fileName)
+    name := fileName[0:len(fileName)-len(extension)]
+    return name
+}
+
+// NewFile creates the next file of the counter series of a connection and a writer,
+// rId and wId are omitted from the name if 0
+func NewFile(fileName string, extension string, rId int, wId int, counter *int) (*os.File, error) {
+    *counter++;
+
+    fn := fileName;
+    if rId != 0 {
+        fn += fmt.Sprintf("_%d", rId)
+    }
+    if wId != 0 {
+        fn += fmt.Sprintf("_%d", wId)
+    }
+    fn += fmt.Sprintf("_%07d." + extension, *counter);
+
+    return os.Create(fn)
+}
+
+func OpenStream(name string, compress bool, bom []byte) (*Stream, error) {
+    s := &Stream{f: os.Stdout}
+
+    if name != "-" {
+        f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+        if err != nil {
+            return nil, err
+        }
+        s.f = f
+    }
+
+    s.w = bufio.NewWriter(s.f)
+    if compress {
+        s.gz = gzip.NewWriter(s.f)
+        s.w = bufio.NewWriter(s.gz)
+    }
+
+    if _, err := s.w.Write(bom); err != nil {
+        return nil, err
+    }
+
+    return s, nil
+}
+
+func (s *Stream) WriteLine(line []byte) error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    _, err := s.w.Write(line)
+    return err
+}
+
+// Close flushes and closes the stream, returns the first error
+func (s *Stream) Close() error {
+    err := s.w.Flush()
+
+    if s.gz != nil {
+        if gzErr := s.gz.Close(); err == nil {
+            err = gzErr
+        }
+    }
+
+    if s.f == os.Stdout {
+        return err
+    }
+    if closeErr := s.f.Close(); err == nil {
+        err = closeErr
+    }
+    return err
+}
+
+// WriteToStream encodes the batches and writes them to the stream, in the order of their Seq like WriteToFile
+func WriteToStream(rId int, params Params, s *Stream, ciRows <- chan *RowBatch) {
+    enc := NewEncoder(params)
+    worker := params.Progress.Worker(rId)
+    failed := false
+
+    OrderBatches(0, params, ciRows, func(batch *RowBatch) {
+        // Strict encoding error, skip the rest
+        if failed {
+            batch.Release()
+            return
+        }
+
+        start := time.Now()
+        if err := enc.EncodeBatch(batch); err != nil {
+            params.Manifest.Fail(err)
+            failed = true
+            batch.Release()
+            return
+        }
+
+        // Broken pipe or full disk, skip the rest
+        if err := s.WriteLine(batch.Lines); err != nil {
+            Log("WriteToStream", err)
+            params.Manifest.Fail(err)
+            failed = true
+            batch.Release()
+            return
+        }
+        params.Metrics.Write.Record(batch.Rows, len(batch.Lines), start)
+        params.Progress.AddRows(worker, batch.Rows, len(batch.Lines))
+        batch.Release()
+    })
+
+    params.Manifest.AddReplaced(enc.Replaced)
+}
+
+// OutputFile is a file of WriteToFile. With compression batches are passed to
+// a compressor goroutine, which closes the file and adds it to the manifest
+type OutputFile struct {
+    f           *os.File
+    w           *bufio.Writer
+    cBatches    chan *RowBatch
+    params      Params
+    Size        int64
+    Rows        int
+    err         error
+}
+
+func NewOutputFile(params Params, extension string, rId int, wId int, counter *int, bom []byte, compressors *sync.WaitGroup) (*OutputFile, error) {
+    if params.Compress {
+        extension += ".gz"
+    }
+
+    f, err := NewFile(params.FileName, extension, rId, wId, counter)
+    if err != nil {
+        return nil, err
+    }
+    of := &OutputFile{f: f, w: bufio.NewWriterSize(params.Progress.Writer(rId, f), 1024 * 1024), params: params}
+
+    if params.Compress {
+        of.cBatches = make(chan *RowBatch, params.PipelineBuffer)
+        compressors.Add(1)
+        go func() {
+            defer compressors.Done()
+            of.Compress()
+        }()
+    }
+
+    if len(bom) > 0 {
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, bom...)
+        of.Write(batch)
+    }
+    return of, nil
+}
+
+// Write takes the batch, Size is the uncompressed size
+func (of *OutputFile) Write(batch *RowBatch) {
+    of.Size += int64(len(batch.Lines))
+    of.Rows += batch.Rows
+
+    if of.cBatches != nil {
+        of.params.Metrics.Compress.Queue(len(of.cBatches))
+        of.cBatches <- batch
+        return
+    }
+
+    if _, err := of.w.Write(batch.Lines); err != nil {
+        of.Fail(err)
+    }
+    batch.Release()
+}
+
+// Fail fails the export with the first write error of the file
+func (of *OutputFile) Fail(err error) {
+    if of.err != nil {
+        return
+    }
+    Log("OutputFile", of.f.Name(), err)
+    of.err = err
+    of.params.Manifest.Fail(err)
+}
+
+// Close closes the file and adds it to the manifest, a compressed file is closed by its compressor
+func (of *OutputFile) Close() {
+    if of.cBatches != nil {
+        close(of.cBatches)
+        return
+    }
+
+    if err := of.w.Flush(); err != nil {
+        of.Fail(err)
+    }
+    if err := of.f.Close(); err != nil {
+        of.Fail(err)
+    }
+    of.params.Manifest.Add(of.f.Name(), of.Rows)
+}
+
+// Compress writes the batches to the file with gzip until the file is closed
+func (of *OutputFile) Compress() {
+    gz := gzip.NewWriter(of.w)
+
+    for batch := range of.cBatches {
+        start := time.Now()
+        if _, err := gz.Write(batch.Lines); err != nil {
+            of.Fail(err)
+        }
+        of.params.Metrics.Compress.Record(batch.Rows, len(batch.Lines), start)
+        batch.Release()
+    }
+
+    if err := gz.Close(); err != nil {
+        of.Fail(err)
+    }
+    if err := of.w.Flush(); err != nil {
+        of.Fail(err)
+    }
+    if err := of.f.Close(); err != nil {
+        of.Fail(err)
+    }
+    of.params.Manifest.Add(of.f.Name(), of.Rows)
+}
+
+// WriteToFile encodes the batches and writes them to files of maxSizeMB. With format workers
+// and Ordered, batches are written in the order of their Seq. Writer wId of several writers
+// gets every Writers-th batch starting with Seq wId - 1. Returns after all files are closed
+func WriteToFile(rId int, wId int, params Params, maxSizeMB int, ciRows <- chan *RowBatch) {
+	counter := 0;
+
+    extension := params.Format.Extension()
+
+    // No rotation while streaming
+    if params.Stream != nil {
+        WriteToStream(rId, params, params.Stream, ciRows)
+        return
+    }
+
+    enc := NewEncoder(params)
+    bom := enc.BOMBytes(params.BOM)
+    worker := params.Progress.Worker(rId)
+    failed := false
+
+    compressionRatio := 1.0;
+    if params.Compress {
+        compressionRatio = 0.11;
+    }
+
+    var compressors sync.WaitGroup
+    defer compressors.Wait()
+
+    of, err := NewOutputFile(params, extension, rId, wId, &counter, bom, &compressors)
+    if err != nil {
+        params.Manifest.Fail(err)
+        failed = true
+    }
+
+    write := func(batch *RowBatch) {
+        // Strict encoding error or no file, skip the rest
+        if failed {
+            batch.Release()
+            return
+        }
+
+    	// Check file size one time per batch
+        if of.Rows > 0 && float64(maxSizeMB) * float64(0.95) <= float64(of.Size) / 1024 / 1024 * compressionRatio {
+            of.Close()
+            if of, err = NewOutputFile(params, extension, rId, wId, &counter, bom, &compressors); err != nil {
+                params.Manifest.Fail(err)
+                failed = true
+                batch.Release()
+                return
+            }
+        }
+
+        start := time.Now()
+        if err := enc.EncodeBatch(batch); err != nil {
+            params.Manifest.Fail(err)
+            failed = true
+            batch.Release()
+            return
+        }
+
+        params.Metrics.Write.Record(batch.Rows, len(batch.Lines), start)
+        params.Progress.AddRows(worker, batch.Rows, len(batch.Lines))
+        of.Write(batch)
+    }
+
+    OrderBatches(wId, params, ciRows, write)
+
+    if of != nil {
+        of.Close()
+    }
+    params.Manifest.AddReplaced(enc.Replaced)
+}
+
+// OrderBatches passes the batches to write. With format workers and Ordered, batches are passed
+// in the order of their Seq, writer wId of several writers gets every Writers-th batch
+func OrderBatches(wId int, params Params, ciRows <- chan *RowBatch, write func(*RowBatch)) {
+    ordered := params.FormatWorkers > 0 && params.Ordered
+    pending := map[int]*RowBatch{}
+    pendingBytes := 0
+    next, step := 0, 1
+    if wId > 0 {
+        next, step = wId - 1, params.Writers
+    }
+
+    for batch := range ciRows {
+        if !ordered {
+            write(batch)
+            continue
+        }
+
+        // Batches wait for the previous ones
+        pending[batch.Seq] = batch
+        pendingBytes += len(batch.Lines)
+        params.Metrics.Write.Hold(pendingBytes)
+
+        for b, ok := pending[next]; ok; b, ok = pending[next] {
+            delete(pending, next)
+            pendingBytes -= len(b.Lines)
+            write(b)
+            next += step
+        }
+    }
+}
+
+func NewEncoder(params Params) *Encoder {
+    return &Encoder{Name: params.Encoding, Strict: params.EncodingStrict, charset: Charsets[params.Encoding]}
+}
+
+func (e *Encoder) BOMBytes(bom bool) []byte {
+    if !bom {
+        return nil
+    }
+
+    switch e.Name {
+    case "utf-8":
+        return []byte{0xEF, 0xBB, 0xBF}
+    case "utf-16le":
+        return []byte{0xFF, 0xFE}
+    case "utf-16be":
+        return []byte{0xFE, 0xFF}
+    }
+    return nil
+}
+
+// EncodeBatch encodes the lines of the batch in place, the buffers of the encoder and the batch are swapped
+func (e *Encoder) EncodeBatch(batch *RowBatch) error {
+    lines, err := e.Encode(batch.Lines)
+    if err != nil {
+        return err
+    }
+    if e.Name != "utf-8" {
+        e.buf, batch.Lines = batch.Lines[:0], lines
+    }
+    return nil
+}
+
+// Encode encodes a batch of lines, the result is a buffer reused by the next call
+func (e *Encoder) Encode(b []byte) ([]byte, error) {
+    if e.Name == "utf-8" {
+        return b, nil
+    }
+
+    e.buf = e.buf[:0]
+    for i := 0; i < len(b); {
+        r, size := utf8.DecodeRune(b[i:])
+
+        // Invalid UTF-8, a valid U+FFFD has 3 bytes
+        if r == utf8.RuneError && size == 1 {
+            end := i + 40
+            if end > len(b) {
+                end = len(b)
+            }
+            if e.Strict {
+                return nil, fmt.Errorf("Invalid UTF-8 in %q", b[i:end])
+            }
+            e.Invalid++
+            if e.Invalid == 1 {
+                Log("... Invalid UTF-8 replaced in", e.Name, "output, first in", fmt.Sprintf("%q", b[i:end]))
+            }
+        }
+
+        switch {
+        case e.charset.Charmap != nil:
+            c, ok := e.charset.Charmap.EncodeRune(r)
+            if !ok {
+                if e.Strict {
+                    return nil, fmt.Errorf("Character %q is not representable in %s", r, e.Name)
+                }
+                e.Replaced++
+                c = '?'
+            }
+            e.buf = append(e.buf, c)
+
+        default:
+            if r == utf8.RuneError && size == 1 {
+                e.Replaced++
+            }
+
+            // UTF-16, surrogate pairs above U+FFFF
+            units := []uint16{uint16(r)}
+            if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+                units = []uint16{uint16(r1), uint16(r2)}
+            }
+            for _, u := range units {
+                if e.Name == "utf-16le" {
+                    e.buf = append(e.buf, byte(u), byte(u >> 8))
+                } else {
+                    e.buf = append(e.buf, byte(u >> 8), byte(u))
+                }
+            }
+        }
+
+        i += size
+    }
+
+    return e.buf, nil
+}
+
+func (m *Manifest) Add(fileName string, rows int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.Files = append(m.Files, ExportFile{fileName, rows})
+}
+
+func (m *Manifest) AddReplaced(n int) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.Replaced += n
+}
+
+func (m *Manifest) Fail(err error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    m.Errors = append(m.Errors, err)
+}
+
+// SetColumnTypes keeps the column types of the first query, returns true only for the first call
+func (m *Manifest) SetColumnTypes(columnTypes []*sql.ColumnType) bool {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if m.ColumnTypes != nil {
+        return false
+    }
+    m.ColumnTypes = columnTypes
+    return true
+}
+
+func (m *Manifest) Err() error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    if len(m.Errors) == 0 {
+        return nil
+    }
+    return fmt.Errorf("%d error(s), first: %v", len(m.Errors), m.Errors[0])
+}
+
+// Write saves the list of files with row counts, one "file<TAB>rows" per line
+func (m *Manifest) Write(fileName string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    f, err := os.Create(fileName)
+    if err != nil {
+        return err
+    }
+
+    for _, ef := range m.Files {
+        fmt.Fprintf(f, "%s\t%d\n", filepath.Base(ef.Name), ef.Rows)
+    }
+
+    return f.Close()
+}
+
+// EscapedLiteral is a string literal with backslash escapes, as Snowflake and PostgreSQL E'' strings
+func EscapedLiteral(s string) string {
+    return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'", "\t", "\\t", "\r", "\\r", "\n", "\\n").Replace(s) + "'"
+}
+
+func HexLiteral(s string) string {
+    return fmt.Sprintf("X'%X'", s)
+}
+
+func SnowflakeFileFormat(params Params) string {
+    f := params.Format
+
+    enclosed := "NONE"
+    escape := "NONE"
+    if f.Quoting != "none" {
+        enclosed = EscapedLiteral(f.Quote)
+        if f.Escape == "backslash" {
+            escape = EscapedLiteral("\\")
+        }
+    }
+
+    escapeUnenclosed := "NONE"
+    if f.Escape == "backslash" {
+        escapeUnenclosed = EscapedLiteral("\\")
+    }
+
+    encoding := ""
+    if name := Charsets[params.Encoding].Snowflake; name != "" && name != "UTF8" {
+        encoding = " ENCODING = '" + name + "'"
+    }
+
+    return fmt.Sprintf("TYPE = CSV FIELD_DELIMITER = %s RECORD_DELIMITER = %s FIELD_OPTIONALLY_ENCLOSED_BY = %s " +
+        "ESCAPE = %s ESCAPE_UNENCLOSED_FIELD = %s NULL_IF = (%s) EMPTY_FIELD_AS_NULL = %t COMPRESSION = GZIP%s",
+        EscapedLiteral(f.Sep), EscapedLiteral(f.LineEnd), enclosed, escape, escapeUnenclosed,
+        EscapedLiteral(f.Null), f.Null == "", encoding)
+}
+
+// SnowflakeCopySQL converts date time columns with the masks of the export layouts,
+// a file format has only one TIMESTAMP_FORMAT for all timestamp types
+func SnowflakeCopySQL(params Params, table string, stage string, files string, fileFormat string) string {
+    columnTypes := params.Manifest.ColumnTypes
+    if columnTypes == nil {
+        return fmt.Sprintf("COPY INTO %s FROM %s %s FILE_FORMAT = %s", table, stage, files, fileFormat)
+    }
+
+    columns := make([]string, len(columnTypes))
+    values := make([]string, len(columnTypes))
+    for i, c := range columnTypes {
+        columns[i] = QuoteIdentifier("snowflake", c.Name())
+        values[i] = fmt.Sprintf("$%d", i + 1)
+
+        function := map[string]string{"DATE": "TO_TIMESTAMP_NTZ", "TIMESTAMP": "TO_TIMESTAMP_NTZ",
+            "TIMESTAMP WITH TIME ZONE": "TO_TIMESTAMP_TZ", "TIMESTAMP WITH LOCAL TIME ZONE": "TO_TIMESTAMP_LTZ"}[c.DatabaseTypeName()]
+        if function == "" {
+            continue
+        }
+
+        // Without a mask Snowflake detects ISO 8601 and epoch values
+        if mask, ok := TimeMask(params, c); ok {
+            values[i] = fmt.Sprintf("%s($%d, '%s')", function, i + 1, mask)
+        } else {
+            values[i] = fmt.Sprintf("%s($%d)", function, i + 1)
+        }
+    }
+
+    return fmt.Sprintf("COPY INTO %s (%s) FROM (SELECT %s FROM %s) %s FILE_FORMAT = %s",
+        table, strings.Join(columns, ", "), strings.Join(values, ", "), stage, files, fileFormat)
+}
+
+func LoadToSnowflake(params Params, files []ExportFile) error {
+    Log("... Setting up Snowflake Connection")
+    connStr, err := ResolveSecrets(params.SfConnStr)
+    if err != nil {
+        return err
+    }
+
+    db, err := sql.Open("snowflake", connStr)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    if err = db.Ping(); err != nil {
+        return err
+    }
+
+    stage := params.SfStage
+    if stage == "" {
+        stage = "@%" + params.SfTable
+    }
+
+    for _, ef := range files {
+        path, err := filepath.Abs(ef.Name)
+        if err != nil {
+            return err
+        }
+
+        // Files are stored gzipped on the stage
+        stagedName := filepath.Base(ef.Name)
+        put := fmt.Sprintf("PUT 'file://%s' %s OVERWRITE = TRUE", filepath.ToSlash(path), stage)
+        if params.Compress {
+            put += " SOURCE_COMPRESSION = GZIP AUTO_COMPRESS = FALSE"
+        } else {
+            put += " AUTO_COMPRESS = TRUE"
+            stagedName += ".gz"
+        }
+
+        Log("... PUT", ef.Name, stage)
+        if _, err = db.Exec(put); err != nil {
+            return err
+        }
+
+        Log("... COPY INTO", params.SfTable, stagedName)
+        rows, err := db.Query(SnowflakeCopySQL(params, params.SfTable, stage,
+            fmt.Sprintf("FILES = ('%s')", stagedName), "(" + SnowflakeFileFormat(params) + ")"))
+        if err != nil {
+            return err
+        }
+
+        loaded, err := CopyRowsLoaded(rows)
+        rows.Close()
+        if err != nil {
+            return err
+        }
+
+        if loaded != ef.Rows {
+            return fmt.Errorf("COPY INTO %s from %s: %d rows loaded, %d rows exported", params.SfTable, stagedName, loaded, ef.Rows)
+        }
+    }
+
+    return nil
+}
+
+// CopyRowsLoaded sums rows_loaded of the COPY INTO result and fails on load errors
+func CopyRowsLoaded(rows *sql.Rows) (int, error) {
+    columns, err := rows.Columns()
+    if err != nil {
+        return 0, err
+    }
+
+    values := make([]interface{}, len(columns))
+    for i := range values {
+        values[i] = &sql.NullString{}
+    }
+
+    loaded := 0
+    for rows.Next() {
+        if err := rows.Scan(values...); err != nil {
+            return 0, err
+        }
+
+        result := map[string]string{}
+        for i, c := range columns {
+            result[strings.ToLower(c)] = values[i].(*sql.NullString).String
+        }
+
+        if status := result["status"]; status == "LOAD_FAILED" || status == "PARTIALLY_LOADED" {
+            return 0, fmt.Errorf("COPY INTO %s: %s, first error: %s", result["file"], status, result["first_error"])
+        }
+
+        if n, err := strconv.Atoi(result["rows_loaded"]); err == nil {
+            loaded += n
+        }
+    }
+
+    return loaded, rows.Err()
+}
+
+// Dialect of the target database by driver name
+func DriverDialect(driver string) string {
+    switch driver {
+    case "godror":
+        return "oracle"
+    case "snowflake":
+        return "snowflake"
+    }
+    return driver
+}
+
+func ConnectToTarget(driver string, connStr string) (*sql.DB, error) {
+    if driver == "godror" {
+        return ConnectToDB(connStr)
+    }
+
+    connStr, err := ResolveSecrets(connStr)
+    if err != nil {
+        return nil, err
+    }
+
+    db, err := sql.Open(driver, connStr)
+    if err != nil {
+        return nil, err
+    }
+
+    if err = db.Ping(); err != nil {
+        return nil, err
+    }
+
+    if driver == "snowflake" {
+        if _, err = db.Exec("alter session set timezone='UTC'"); err != nil {
+            return nil, err
+        }
+    }
+
+    return db, nil
+}
+
+func QuoteIdentifier(dialect string, name string) string {
+    if dialect == "bigquery" {
+        return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+    }
+    return "\"" + strings.ReplaceAll(name, "\"", "\"\"") + "\""
+}
+
+// ColumnDDL maps an Oracle column type to the type of the target dialect
+// (oracle, snowflake, postgres, bigquery), sfNumber is the Snowflake type of NUMBER without precision
+func ColumnDDL(dialect string, c *sql.ColumnType, sfNumber string) string {
+    typeName := c.DatabaseTypeName()
+    precision, scale, hasDecimal := c.DecimalSize()
+    length, hasLength := c.Length()
+    if !hasLength || length <= 0 {
+        length = 0
+    }
+
+    switch typeName {
+    case "NUMBER":
+        // NUMBER without precision (scale -127), Snowflake has no decimal type without a fixed scale
+        if !hasDecimal || precision == 0 {
+            return map[string]string{"oracle": "NUMBER", "snowflake": sfNumber,
+                "postgres": "NUMERIC", "bigquery": "BIGNUMERIC"}[dialect]
+        }
+        // FLOAT has a binary precision and a negative scale
+        if scale < 0 {
+            return map[string]string{"oracle": "NUMBER", "snowflake": "FLOAT",
+                "postgres": "DOUBLE PRECISION", "bigquery": "FLOAT64"}[dialect]
+        }
+        switch dialect {
+        case "postgres":
+            return fmt.Sprintf("NUMERIC(%d,%d)", precision, scale)
+        case "bigquery":
+            if scale == 0 && precision <= 18 {
+                return "INT64"
+            }
+            if precision - scale <= 29 && scale <= 9 {
+                return fmt.Sprintf("NUMERIC(%d,%d)", precision, scale)
+            }
+            return fmt.Sprintf("BIGNUMERIC(%d,%d)", precision, scale)
+        }
+        return fmt.Sprintf("NUMBER(%d,%d)", precision, scale)
+
+    case "VARCHAR2", "NVARCHAR2":
+        switch dialect {
+        case "oracle":
+            if length == 0 {
+                length = 4000
+            }
+            return fmt.Sprintf("%s(%d)", typeName, length)
+        case "bigquery":
+            return "STRING"
+        }
+        if length == 0 {
+            return map[string]string{"snowflake": "VARCHAR", "postgres": "TEXT"}[dialect]
+        }
+        return fmt.Sprintf("VARCHAR(%d)", length)
+
+    // Values are blank-padded to the length
+    case "CHAR", "NCHAR":
+        if length == 0 {
+            length = 1
+        }
+        switch dialect {
+        case "oracle":
+            return fmt.Sprintf("%s(%d)", typeName, length)
+        case "postgres":
+            return fmt.Sprintf("CHAR(%d)", length)
+        case "bigquery":
+            return "STRING"
+        }
+        return fmt.Sprintf("VARCHAR(%d)", length)
+
+    case "CLOB", "NCLOB":
+        return map[string]string{"oracle": typeName, "snowflake": "VARCHAR",
+            "postgres": "TEXT", "bigquery": "STRING"}[dialect]
+
+    case "DATE":
+        return map[string]string{"oracle": "DATE", "snowflake": "TIMESTAMP_NTZ(0)",
+            "postgres": "TIMESTAMP(0)", "bigquery": "DATETIME"}[dialect]
+
+    case "TIMESTAMP":
+        return map[string]string{"oracle": "TIMESTAMP(9)", "snowflake": "TIMESTAMP_NTZ(9)",
+            "postgres": "TIMESTAMP(6)", "bigquery": "DATETIME"}[dialect]
+
+    case "TIMESTAMP WITH TIME ZONE":
+        return map[string]string{"oracle": "TIMESTAMP(9) WITH TIME ZONE", "snowflake": "TIMESTAMP_TZ(9)",
+            "postgres": "TIMESTAMPTZ(6)", "bigquery": "TIMESTAMP"}[dialect]
+
+    case "TIMESTAMP WITH LOCAL TIME ZONE":
+        return map[string]string{"oracle": "TIMESTAMP(9) WITH LOCAL TIME ZONE", "snowflake": "TIMESTAMP_LTZ(9)",
+            "postgres": "TIMESTAMPTZ(6)", "bigquery": "TIMESTAMP"}[dialect]
+    }
+    return typeName
+}
+
+func CreateTableDDL(dialect string, table string, columnTypes []*sql.ColumnType, sfNumber string) string {
+    columns := make([]string, len(columnTypes))
+    for i, c := range columnTypes {
+        columns[i] = "    " + QuoteIdentifier(dialect, c.Name()) + " " + ColumnDDL(dialect, c, sfNumber)
+    }
+    return "CREATE TABLE " + table + " (\n" + strings.Join(columns, ",\n") + "\n)"
+}
+
+// Target table name of DDL and loader files
+func DDLTableName(params Params) string {
+    if params.DDLTable != "" {
+        return params.DDLTable
+    }
+    return strings.ToUpper(filepath.Base(params.FileName))
+}
+
+// WriteDDL writes CREATE TABLE of every dialect to <fname>.<dialect>.sql
+func WriteDDL(params Params, columnTypes []*sql.ColumnType) {
+    table := DDLTableName(params)
+
+    for _, dialect := range params.DDL {
+        fileName := params.FileName + "." + dialect + ".sql"
+        err := ioutil.WriteFile(fileName, []byte(CreateTableDDL(dialect, table, columnTypes, params.SfNumber) + ";\n"), 0644)
+        if err != nil {
+            Log("WriteDDL", err)
+        }
+    }
+}
+
+func CreateTableIfMissing(db *sql.DB, dialect string, table string, columnTypes []*sql.ColumnType, sfNumber string) error {
+    rows, err := db.Query("SELECT * FROM " + table + " WHERE 1 = 0")
+    if err == nil {
+        return rows.Close()
+    }
+
+    ddl := CreateTableDDL(dialect, table, columnTypes, sfNumber)
+    Log("... Creating table", table)
+    Log(ddl)
+
+    _, err = db.Exec(ddl)
+    return err
+}
+
+// InsertSQL builds a multi-row INSERT for rowCount rows. Oracle gets a single-row
+// INSERT, which godror executes for every row of the array binds
+func InsertSQL(dialect string, table string, columnCount int, rowCount int) string {
+    var b strings.Builder
+
+    b.WriteString("INSERT INTO " + table + " VALUES")
+
+    if dialect == "oracle" {
+        b.WriteString(" (")
+        for c := 1; c <= columnCount; c++ {
+            if c > 1 {
+                b.WriteString(", ")
+            }
+            b.WriteString(":" + strconv.Itoa(c))
+        }
+        b.WriteString(")")
+        return b.String()
+    }
+
+    for r := 0; r < rowCount; r++ {
+        if r == 0 {
+            b.WriteString(" (")
+        } else {
+            b.WriteString(", (")
+        }
+
+        for c := 0; c < columnCount; c++ {
+            if c > 0 {
+                b.WriteString(", ")
+            }
+            b.WriteString("?")
+        }
+        b.WriteString(")")
+    }
+
+    return b.String()
+}
+
+// ArrayBinds returns empty column slices for the scanned row: dates as []time.Time, where
+// the zero time is NULL, other values as []string, where the empty string is NULL in Oracle
+func ArrayBinds(row []interface{}, size int) []interface{} {
+    columns := make([]interface{}, len(row))
+    for i, col := range row {
+        if _, ok := col.(*sql.NullTime); ok {
+            columns[i] = make([]time.Time, 0, size)
+        } else {
+            columns[i] = make([]string, 0, size)
+        }
+    }
+    return columns
+}
+
+// AppendArrayBinds appends the scanned row to the column slices
+func AppendArrayBinds(columns []interface{}, row []interface{}) {
+    for i, col := range row {
+        switch v := col.(type) {
+        case *sql.NullTime:
+            t := time.Time{}
+            if v.Valid {
+                t = v.Time
+            }
+            columns[i] = append(columns[i].([]time.Time), t)
+        case *sql.NullString:
+            columns[i] = append(columns[i].([]string), v.String)
+        case *LobString:
+            columns[i] = append(columns[i].([]string), v.String)
+        default:
+            columns[i] = append(columns[i].([]string), "")
+        }
+    }
+}
+
+// ResetArrayBinds empties the column slices for the next batch
+func ResetArrayBinds(columns []interface{}) {
+    for i, col := range columns {
+        switch v := col.(type) {
+        case []time.Time:
+            columns[i] = v[:0]
+        case []string:
+            columns[i] = v[:0]
+        }
+    }
+}
+
+// ColumnValue returns a copy of the scanned value to bind
+func ColumnValue(i interface{}) interface{} {
+    switch v := i.(type) {
+    case *sql.NullString:
+        return *v
+    case *sql.NullFloat64:
+        return *v
+    case *sql.NullTime:
+        return *v
+    case *LobString:
+        return v.NullString
+    }
+    return nil
+}
+
+func CopyTable(q Queryer, params Params) error {
+    Log("... Setting up Target Connection")
+    target, err := ConnectToTarget(params.TargetDriver, params.TargetConnStr)
+    if err != nil {
+        return err
+    }
+    defer target.Close()
+
+    // Exec query
+    rows, err := q.QueryContext(context.Background(), params.Query, append(QueryArgs(params.Query, params.Binds), params.FetchOptions...)...)
+    if err != nil {
+        return err
+    }
+    defer rows.Close()
+
+    // Define column types
+    columnTypes, row, _, err := DefineColumnTypes(rows, params.Format)
+    if err != nil {
+        return err
+    }
+
+    dialect := DriverDialect(params.TargetDriver)
+    if err = CreateTableIfMissing(target, dialect, params.TargetTable, columnTypes, params.SfNumber); err != nil {
+        return err
+    }
+
+    // One session for the NLS settings of the inserts
+    ctx := context.Background()
+    conn, err := target.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer conn.Close()
+
+    batchSize := params.InsertBatch
+    if batchSize < 1 {
+        batchSize = 1
+    }
+
+    count := 0
+    total := 0
+
+    Log("... Copying rows")
+    if dialect == "oracle" {
+        // NUMBER values are bound as text with the decimal point, dates are in UTC
+        for _, stmt := range []string{"ALTER SESSION SET NLS_NUMERIC_CHARACTERS = '.,'", "ALTER SESSION SET TIME_ZONE = 'UTC'"} {
+            if _, err = conn.ExecContext(ctx, stmt); err != nil {
+                return err
+            }
+        }
+
+        insertSQL := InsertSQL(dialect, params.TargetTable, len(row), 1)
+        columns := ArrayBinds(row, batchSize)
+
+        for rows.Next() {
+            if err = rows.Scan(row...); err != nil {
+                return err
+            }
+
+            AppendArrayBinds(columns, row)
+            count++
+
+            if count == batchSize {
+                if _, err = conn.ExecContext(ctx, insertSQL, columns...); err != nil {
+                    return err
+                }
+                total += count
+                count = 0
+                ResetArrayBinds(columns)
+            }
+        }
+        if err = rows.Err(); err != nil {
+            return err
+        }
+
+        if count > 0 {
+            if _, err = conn.ExecContext(ctx, insertSQL, columns...); err != nil {
+                return err
+            }
+            total += count
+        }
+
+        Log("...", total, "rows copied to", params.TargetTable)
+        return nil
+    }
+
+    // Keep the number of binds of one INSERT below the limit of the driver
+    if batchSize * len(row) > 60000 {
+        batchSize = 60000 / len(row)
+    }
+    if batchSize < 1 {
+        batchSize = 1
+    }
+
+    batchSQL := InsertSQL(dialect, params.TargetTable, len(row), batchSize)
+    batch := make([]interface{}, 0, batchSize * len(row))
+
+    for rows.Next() {
+        if err = rows.Scan(row...); err != nil {
+            return err
+        }
+
+        for _, col := range row {
+            batch = append(batch, ColumnValue(col))
+        }
+        count++
+
+        if count == batchSize {
+            if _, err = conn.ExecContext(ctx, batchSQL, batch...); err != nil {
+                return err
+            }
+            total += count
+            count = 0
+            batch = batch[:0]
+        }
+    }
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    if count > 0 {
+        if _, err = conn.ExecContext(ctx, InsertSQL(dialect, params.TargetTable, len(row), count), batch...); err != nil {
+            return err
+        }
+        total += count
+    }
+
+    Log("...", total, "rows copied to", params.TargetTable)
+    return nil
+}
+
+// Tokens of Go layouts and Oracle / Snowflake format masks, longest first
+var maskTokens = [][2]string{
+    {".000000000", ".FF9"}, {".000000", ".FF6"}, {".000", ".FF3"},
+    {"-07:00", "TZH:TZM"}, {"-0700", "TZHTZM"},
+    {"2006", "YYYY"}, {"01", "MM"}, {"02", "DD"}, {"15", "HH24"}, {"04", "MI"}, {"05", "SS"},
+    {"T", "\"T\""},
+}
+
+// LayoutToMask converts a Go time layout to an Oracle / Snowflake format mask,
+// returns false for epoch values and layouts with other elements (names, Z07:00, ...)
+func LayoutToMask(layout string) (string, bool) {
+    var b strings.Builder
+
+    if layout == "epoch" || layout == "epochms" {
+        return "", false
+    }
+
+    for i := 0; i < len(layout); {
+        matched := false
+        for _, t := range maskTokens {
+            if strings.HasPrefix(layout[i:], t[0]) {
+                b.WriteString(t[1])
+                i += len(t[0])
+                matched = true
+                break
+            }
+        }
+        if !matched {
+            c := layout[i]
+            if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+                return "", false
+            }
+            b.WriteByte(c)
+            i++
+        }
+    }
+
+    return b.String(), true
+}
+
+// TimeMask is the format mask of the date time layout of the column. A layout without a mask,
+// other than epoch, is logged: Snowflake detects the format and SQL*Loader skips the column
+func TimeMask(params Params, c *sql.ColumnType) (string, bool) {
+    layout := params.Format.TimeLayouts[c.DatabaseTypeName()]
+    mask, ok := LayoutToMask(layout)
+    if !ok && layout != "epoch" && layout != "epochms" {
+        Log("... No format mask for the layout", layout, "of", c.Name())
+    }
+    return mask, ok
+}
+
+// Names of exported files without directory
+func LoaderFiles(params Params) []string {
+    names := []string{}
+    for _, ef := range params.Manifest.Files {
+        names = append(names, filepath.Base(ef.Name))
+    }
+    return names
+}
+
+func SQLLoaderControl(params Params) string {
+    var b strings.Builder
+
+    if params.Compress {
+        b.WriteString("-- SQL*Loader reads uncompressed files, gunzip the files before loading\n")
+    }
+    if params.Format.Escape == "backslash" {
+        b.WriteString("-- SQL*Loader does not support backslash escapes\n")
+    }
+    b.WriteString("LOAD DATA\nCHARACTERSET " + Charsets[params.Encoding].Oracle + "\n")
+    for _, name := range LoaderFiles(params) {
+        b.WriteString("INFILE '" + strings.TrimSuffix(name, ".gz") + "'")
+        if params.Format.LineEnd == "\r\n" {
+            b.WriteString(" \"str '\\r\\n'\"")
+        }
+        b.WriteString("\n")
+    }
+    b.WriteString("APPEND INTO TABLE " + DDLTableName(params) + "\n")
+
+    b.WriteString("FIELDS TERMINATED BY " + HexLiteral(params.Format.Sep))
+    if params.Format.Quoting != "none" {
+        b.WriteString(" OPTIONALLY ENCLOSED BY " + HexLiteral(params.Format.Quote))
+    }
+    b.WriteString("\nTRAILING NULLCOLS\n(\n")
+
+    columns := []string{}
+    unsupported := []string{}
+    for _, c := range params.Manifest.ColumnTypes {
+        column := "    " + QuoteIdentifier("oracle", c.Name())
+        typeName := c.DatabaseTypeName()
+
+        switch typeName {
+        case "VARCHAR2", "NVARCHAR2", "CHAR", "NCHAR":
+            length, ok := c.Length()
+            if !ok || length <= 0 {
+                length = 4000
+            }
+            column += fmt.Sprintf(" CHAR(%d)", length)
+        case "CLOB", "NCLOB":
+            column += " CHAR(1000000)"
+        case "DATE", "TIMESTAMP", "TIMESTAMP WITH TIME ZONE", "TIMESTAMP WITH LOCAL TIME ZONE":
+            mask, ok := TimeMask(params, c)
+            if !ok {
+                unsupported = append(unsupported, c.Name())
+                break
+            }
+            column += " " + typeName + " \"" + strings.ReplaceAll(mask, "\"", "\\\"") + "\""
+        }
+        if params.Format.Null != "" {
+            column += " NULLIF " + QuoteIdentifier("oracle", c.Name()) + " = " + HexLiteral(params.Format.Null)
+        }
+        columns = append(columns, column)
+    }
+    b.WriteString(strings.Join(columns, ",\n") + "\n)\n")
+
+    if len(unsupported) > 0 {
+        b.WriteString("-- SQL*Loader has no mask for the date time format of " + strings.Join(unsupported, ", ") + "\n")
+    }
+
+    return b.String()
+}
+
+func SnowflakeLoader(params Params) string {
+    table := DDLTableName(params)
+    format := table + "_FORMAT"
+
+    stage := params.SfStage
+    if stage == "" {
+        stage = "@%" + table
+    }
+
+    pattern := fmt.Sprintf("PATTERN = '.*%s_.*'", regexp.QuoteMeta(filepath.Base(params.FileName)))
+
+    return "CREATE OR REPLACE FILE FORMAT " + format + " " + SnowflakeFileFormat(params) + ";\n\n" +
+        SnowflakeCopySQL(params, table, stage, pattern, "(FORMAT_NAME = '" + format + "')") + ";\n"
+}
+
+func PostgresLoader(params Params) string {
+    var b strings.Builder
+
+    f := params.Format
+    if len(f.Sep) != 1 {
+        b.WriteString("-- PostgreSQL COPY supports a single character delimiter only\n")
+    }
+
+    // Text format has backslash escapes and no quotes
+    options := "FORMAT text, DELIMITER E" + EscapedLiteral(f.Sep) + ", NULL E" + EscapedLiteral(f.Null)
+    if f.Quoting != "none" {
+        options = "FORMAT csv, DELIMITER E" + EscapedLiteral(f.Sep) + ", QUOTE E" + EscapedLiteral(f.Quote) +
+            ", NULL E" + EscapedLiteral(f.Null)
+        if f.Escape == "backslash" {
+            options += ", ESCAPE E" + EscapedLiteral("\\")
+        }
+    }
+
+    columns := []string{}
+    for _, c := range params.Manifest.ColumnTypes {
+        columns = append(columns, QuoteIdentifier("postgres", c.Name()))
+    }
+
+    for _, c := range params.Manifest.ColumnTypes {
+        if layout := f.TimeLayouts[c.DatabaseTypeName()]; layout == "epoch" || layout == "epochms" {
+            b.WriteString("-- PostgreSQL COPY does not read epoch values of " + c.Name() + "\n")
+        }
+    }
+
+    table := DDLTableName(params)
+
+    // Date time values are ISO, year first
+    b.WriteString("SET datestyle = 'ISO, YMD';\n")
+    if name := Charsets[params.Encoding].Postgres; name != "" {
+        b.WriteString("SET client_encoding = '" + name + "';\n")
+    } else {
+        b.WriteString("-- PostgreSQL does not read " + params.Encoding + "\n")
+    }
+    for _, name := range LoaderFiles(params) {
+        source := "'" + name + "'"
+        if strings.HasSuffix(name, ".gz") {
+            source = "PROGRAM 'gzip -dc " + name + "'"
+        }
+        b.WriteString(fmt.Sprintf("\\copy %s (%s) FROM %s WITH (%s)\n", table, strings.Join(columns, ", "), source, options))
+    }
+
+    return b.String()
+}
+
+// WriteLoaders writes <fname>.ctl, <fname>.snowflake_copy.sql and <fname>.postgres_copy.sql
+func WriteLoaders(params Params) {
+    if params.Manifest.ColumnTypes == nil {
+        return
+    }
+
+    for _, loader := range params.Loaders {
+        fileName := ""
+        content := ""
+
+        switch loader {
+        case "sqlldr":
+            fileName = params.FileName + ".ctl"
+            content = SQLLoaderControl(params)
+        case "snowflake":
+            fileName = params.FileName + ".snowflake_copy.sql"
+            content = SnowflakeLoader(params)
+        case "postgres":
+            fileName = params.FileName + ".postgres_copy.sql"
+            content = PostgresLoader(params)
+        }
+
+        if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+            Log("WriteLoaders", err)
+        }
+    }
+}
+
+// ParseMasks reads COLUMN=kind[:arg] items, column names are case-insensitive
+func ParseMasks(spec []string) (map[string]Mask, error) {
+    masks := map[string]Mask{}
+
+    for _, item := range spec {
+        item = strings.TrimSpace(item)
+        if item == "" || strings.HasPrefix(item, "#") {
+            continue
+        }
+
+        i := strings.Index(item, "=")
+        if i <= 0 {
+            return nil, fmt.Errorf("Wrong mask: %s", item)
+        }
+
+        m := Mask{Kind: strings.TrimSpace(item[i + 1:])}
+        if j := strings.Index(m.Kind, ":"); j >= 0 {
+            m.Kind, m.Arg = m.Kind[:j], m.Kind[j + 1:]
+        }
+
+        switch m.Kind {
+        case "hash", "redact", "token":
+        case "truncate":
+            if n, err := strconv.Atoi(m.Arg); err != nil || n < 0 {
+                return nil, fmt.Errorf("Wrong truncate length: %s", item)
+            }
+        case "fake":
+            if fakeValues[m.Arg] == nil && m.Arg != "email" && m.Arg != "phone" {
+                return nil, fmt.Errorf("Unknown fake kind: %s", item)
+            }
+        default:
+            return nil, fmt.Errorf("Unknown mask: %s", item)
+        }
+
+        masks[strings.ToUpper(strings.TrimSpace(item[:i]))] = m
+    }
+
+    return masks, nil
+}
+
+// CheckMaskSalt fails if a hash, token or fake mask has no salt,
+// without salt masks of short values (phones, dates) are easy to reverse
+func CheckMaskSalt(masks map[string]Mask, salt []byte) error {
+    if len(salt) > 0 {
+        return nil
+    }
+    for column, m := range masks {
+        if m.Kind == "hash" || m.Kind == "token" || m.Kind == "fake" {
+            return fmt.Errorf("Mask %s of %s needs -maskSalt or EXPORT_MASK_SALT", m.Kind, column)
+        }
+    }
+    return nil
+}
+
+// ColumnMasks returns the mask of every column or nil
+func (f Format) ColumnMasks(columnTypes []*sql.ColumnType) []*Mask {
+    masks := make([]*Mask, len(columnTypes))
+    for i, c := range columnTypes {
+        if m, ok := f.Masks[strings.ToUpper(c.Name())]; ok {
+            masks[i] = &m
+        }
+    }
+    return masks
+}
+
+// Digest is the salted SHA-256 (HMAC) of the value, equal values give equal masks
+func Digest(value string, salt []byte) []byte {
+    h := hmac.New(sha256.New, salt)
+    h.Write([]byte(value))
+    return h.Sum(nil)
+}
+
+func (m *Mask) Apply(value string, salt []byte) string {
+    switch m.Kind {
+    case "hash":
+        return hex.EncodeToString(Digest(value, salt))
+    case "redact":
+        if m.Arg != "" {
+            return m.Arg
+        }
+        return "***"
+    case "truncate":
+        n, _ := strconv.Atoi(m.Arg)
+        if runes := []rune(value); len(runes) > n {
+            return string(runes[:n])
+        }
+        return value
+    case "token":
+        return Tokenize(value, salt)
+    case "fake":
+        return Fake(m.Arg, value, salt)
+    }
+    return value
+}
+
+// Tokenize replaces digits with digits and letters with letters of the same alphabet and case,
+// other characters (separators of phones, emails, dates) are kept
+func Tokenize(value string, salt []byte) string {
+    digest := Digest(value, salt)
+    runes := []rune(value)
+
+    for i, r := range runes {
+        // Extend the digest for long values
+        if i > 0 && i % len(digest) == 0 {
+            digest = Digest(value + strconv.Itoa(i), salt)
+        }
+        n := int(digest[i % len(digest)])
+
+        switch {
+        case r >= '0' && r <= '9':
+            runes[i] = rune('0' + n % 10)
+        case unicode.IsLetter(r):
+            if alphabet := LetterAlphabet(r); len(alphabet) > 0 {
+                runes[i] = alphabet[n % len(alphabet)]
+            }
+        }
+    }
+
+    return string(runes)
+}
+
+// Alphabets of tokens by letter, letters of other scripts use the letters of their script
+var tokenAlphabets = NewTokenAlphabets(
+    "abcdefghijklmnopqrstuvwxyz", "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+    "абвгдеёжзийклмнопрстуфхцчшщъыьэюя", "АБВГДЕЁЖЗИЙКЛМНОПРСТУФХЦЧШЩЪЫЬЭЮЯ",
+    "αβγδεζηθικλμνξοπρστυφχψω", "ΑΒΓΔΕΖΗΘΙΚΛΜΝΞΟΠΡΣΤΥΦΧΨΩ")
+
+// Alphabets of scripts by letter, built on first use
+var scriptAlphabets sync.Map
+
+func NewTokenAlphabets(alphabets ...string) map[rune][]rune {
+    m := map[rune][]rune{}
+    for _, a := range alphabets {
+        runes := []rune(a)
+        for _, r := range runes {
+            m[r] = runes
+        }
+    }
+    return m
+}
+
+// LetterAlphabet returns the alphabet of the letter, or the letters of its script and case
+func LetterAlphabet(r rune) []rune {
+    if alphabet, ok := tokenAlphabets[r]; ok {
+        return alphabet
+    }
+    if alphabet, ok := scriptAlphabets.Load(r); ok {
+        return alphabet.([]rune)
+    }
+
+    upper := unicode.IsUpper(r)
+    for _, table := range unicode.Scripts {
+        if !unicode.Is(table, r) {
+            continue
+        }
+
+        alphabet := []rune{}
+        add := func(lo, hi, stride rune) {
+            for c := lo; c <= hi; c += stride {
+                if unicode.IsLetter(c) && unicode.IsUpper(c) == upper {
+                    alphabet = append(alphabet, c)
+                }
+            }
+        }
+        for _, rg := range table.R16 {
+            add(rune(rg.Lo), rune(rg.Hi), rune(rg.Stride))
+        }
+        for _, rg := range table.R32 {
+            add(rune(rg.Lo), rune(rg.Hi), rune(rg.Stride))
+        }
+
+        scriptAlphabets.Store(r, alphabet)
+        return alphabet
+    }
+    return nil
+}
+
+var fakeValues = map[string][]string{
+    "name":         {"Anna", "Boris", "Clara", "David", "Elena", "Fedor", "Galina", "Hugo", "Irina", "John",
+                     "Kira", "Leo", "Maria", "Nikolay", "Olga", "Peter", "Rita", "Sergey", "Tatiana", "Victor"},
+    "lastname":     {"Adams", "Baker", "Clark", "Davis", "Evans", "Fisher", "Green", "Harris", "Ivanov", "Jones",
+                     "King", "Lewis", "Miller", "Nelson", "Orlov", "Petrov", "Smirnov", "Taylor", "Volkov", "Wilson"},
+    "city":         {"Amsterdam", "Berlin", "Chicago", "Dublin", "Helsinki", "Kazan", "Lisbon", "Madrid", "Oslo",
+                     "Prague", "Riga", "Samara", "Tallinn", "Vienna", "Warsaw"},
+}
+
+// Fake picks a deterministic value of the kind: name, lastname, city, email, phone
+func Fake(kind string, value string, salt []byte) string {
+    digest := Digest(value, salt)
+    n := binary.BigEndian.Uint64(digest)
+
+    pick := func(list string, n uint64) string {
+        values := fakeValues[list]
+        return values[n % uint64(len(values))]
+    }
+
+    switch kind {
+    case "email":
+        return fmt.Sprintf("%s.%s%d@example.com", strings.ToLower(pick("name", n)),
+            strings.ToLower(pick("lastname", n >> 16)), n % 10000)
+    case "phone":
+        return fmt.Sprintf("+1555%07d", n % 10000000)
+    case "name":
+        return pick("name", n) + " " + pick("lastname", n >> 16)
+    }
+    return pick(kind, n)
+}
+
+var secretRef = regexp.MustCompile(`\$\{secret:([^}]+)\}`)
+
+// Placeholders of secret references while a connection string is parsed
+var secretPlaceholder = regexp.MustCompile("\x00([0-9]+)\x00")
+
+// Secrets resolved in this run, the keyring is decrypted once
+var (
+    secretMu    sync.Mutex
+    secretCache = map[string]string{}
+)
+
+// ResolveSecrets replaces ${secret:name} with secrets of the configured provider
+func ResolveSecrets(connStr string) (string, error) {
+    var err error
+
+    resolved := secretRef.ReplaceAllStringFunc(connStr, func(ref string) string {
+        secret, e := Secret(secretRef.FindStringSubmatch(ref)[1])
+        if e != nil {
+            if err == nil {
+                err = e
+            }
+            return ref
+        }
+        return secret
+    })
+
+    return resolved, err
+}
+
+// ResolveConnSecrets resolves the secrets of an Oracle connection string user/password@dsn.
+// The string is parsed before the secrets are resolved and the password is quoted by
+// BuildConnStr, so secrets may contain '@', '/' and spaces. Logfmt strings are resolved as is
+func ResolveConnSecrets(connStr string) (string, error) {
+    if !secretRef.MatchString(connStr) || strings.Contains(connStr, "password=") {
+        return ResolveSecrets(connStr)
+    }
+
+    refs := []string{}
+    masked := secretRef.ReplaceAllStringFunc(connStr, func(ref string) string {
+        refs = append(refs, ref)
+        return "\x00" + strconv.Itoa(len(refs) - 1) + "\x00"
+    })
+
+    user, password, dsn, hasPassword := ParseConnStr(masked)
+    if !hasPassword {
+        return ResolveSecrets(connStr)
+    }
+
+    parts := []string{user, password, dsn}
+    for i, part := range parts {
+        part = secretPlaceholder.ReplaceAllStringFunc(part, func(p string) string {
+            n, _ := strconv.Atoi(secretPlaceholder.FindStringSubmatch(p)[1])
+            return refs[n]
+        })
+
+        resolved, err := ResolveSecrets(part)
+        if err != nil {
+            return "", err
+        }
+        parts[i] = resolved
+    }
+
+    return BuildConnStr(parts[0], parts[1], parts[2]), nil
+}
+
+// Secret returns a secret of the configured provider, every secret is read once
+func Secret(name string) (string, error) {
+    secretMu.Lock()
+    defer secretMu.Unlock()
+
+    if secret, ok := secretCache[name]; ok {
+        return secret, nil
+    }
+    if Secrets == nil {
+        return "", fmt.Errorf("Secret %s is referenced, but no -keyring or -secretExec is set", name)
+    }
+
+    secret, err := Secrets.Secret(name)
+    if err != nil {
+        return "", err
+    }
+    secretCache[name] = secret
+    return secret, nil
+}
+
+func (p *ExecProvider) Secret(name string) (string, error) {
+    args := strings.Fields(p.Command)
+    if len(args) == 0 {
+        return "", fmt.Errorf("Empty secret command")
+    }
+
+    cmd := exec.Command(args[0], append(args[1:], name)...)
+    cmd.Stderr = logOut
+
+    out, err := cmd.Output()
+    if err != nil {
+        return "", fmt.Errorf("Secret %s: %s: %v", name, p.Command, err)
+    }
+
+    secret := strings.TrimRight(string(out), "\r\n")
+    if secret == "" {
+        return "", fmt.Errorf("Secret %s: %s printed nothing", name, p.Command)
+    }
+    return secret, nil
+}
+
+func (p *KeyringProvider) Secret(name string) (string, error) {
+    secrets, err := p.Load()
+    if err != nil {
+        return "", err
+    }
+
+    secret, ok := secrets[name]
+    if !ok {
+        return "", fmt.Errorf("Secret %s is not in keyring %s", name, p.FileName)
+    }
+    return secret, nil
+}
+
+func (p *KeyringProvider) key(salt []byte) (cipher.AEAD, error) {
+    key, err := scrypt.Key([]byte(p.Passphrase), salt, 1 << 15, 8, 1, 32)
+    if err != nil {
+        return nil, err
+    }
+
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// Load decrypts all secrets, a missing file is an empty keyring
+func (p *KeyringProvider) Load() (map[string]string, error) {
+    secrets := map[string]string{}
+
+    content, err := ioutil.ReadFile(p.FileName)
+    if os.IsNotExist(err) {
+        return secrets, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    var kf keyringFile
+    if err = json.Unmarshal(content, &kf); err != nil {
+        return nil, fmt.Errorf("Keyring %s: %v", p.FileName, err)
+    }
+
+    aead, err := p.key(kf.Salt)
+    if err != nil {
+        return nil, err
+    }
+
+    data, err := aead.Open(nil, kf.Nonce, kf.Data, nil)
+    if err != nil {
+        return nil, fmt.Errorf("Keyring %s: wrong passphrase or damaged file", p.FileName)
+    }
+
+    if err = json.Unmarshal(data, &secrets); err != nil {
+        return nil, fmt.Errorf("Keyring %s: %v", p.FileName, err)
+    }
+    return secrets, nil
+}
+
+// Save encrypts the secrets with a new salt and nonce
+func (p *KeyringProvider) Save(secrets map[string]string) error {
+    data, err := json.Marshal(secrets)
+    if err != nil {
+        return err
+    }
+
+    kf := keyringFile{Salt: make([]byte, 16)}
+    if _, err = rand.Read(kf.Salt); err != nil {
+        return err
+    }
+
+    aead, err := p.key(kf.Salt)
+    if err != nil {
+        return err
+    }
+
+    kf.Nonce = make([]byte, aead.NonceSize())
+    if _, err = rand.Read(kf.Nonce); err != nil {
+        return err
+    }
+    kf.Data = aead.Seal(nil, kf.Nonce, data, nil)
+
+    content, err := json.Marshal(kf)
+    if err != nil {
+        return err
+    }
+    return ioutil.WriteFile(p.FileName, content, 0600)
+}
+
+func ReadPassphrase() (string, error) {
+    if passphrase, ok := os.LookupEnv("EXPORT_KEYRING_PASSPHRASE"); ok {
+        return passphrase, nil
+    }
+
+    if !terminal.IsTerminal(int(syscall.Stdin)) {
+        return "", fmt.Errorf("Set EXPORT_KEYRING_PASSPHRASE, stdin is not a terminal")
+    }
+
+    fmt.Fprint(logOut, "Enter keyring passphrase: ")
+    passphrase, err := terminal.ReadPassword(int(syscall.Stdin))
+    Log()
+    return string(passphrase), err
+}
+
+// StoreSecret adds a secret read from the terminal or stdin to the keyring
+func StoreSecret(provider SecretProvider, name string, fromStdin bool) error {
+    keyring, ok := provider.(*KeyringProvider)
+    if !ok {
+        return fmt.Errorf("-mode=secret needs -keyring")
+    }
+    if name == "" {
+        return fmt.Errorf("-mode=secret needs -secretName")
+    }
+
+    secrets, err := keyring.Load()
+    if err != nil {
+        return err
+    }
+
+    var secret []byte
+    if fromStdin {
+        line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+        if err != nil && err != io.EOF {
+            return err
+        }
+        secret = []byte(strings.TrimRight(line, "\r\n"))
+    } else {
+        fmt.Fprint(logOut, "Enter secret ", name, ": ")
+        secret, err = terminal.ReadPassword(int(syscall.Stdin))
+        Log()
+        if err != nil {
+            return err
+        }
+    }
+
+    secrets[name] = string(secret)
+    if err = keyring.Save(secrets); err != nil {
+        return err
+    }
+
+    Log("... Secret", name, "stored in", keyring.FileName)
+    return nil
+}
+
+// ParseFlags parses the command line, for "run <job>" values of the job
+// and its profile are applied to flags not set on the command line. Names of
+// connections in -conn, -targetConn and -sfConn are resolved after the values
+// of the command line and the job are merged
+func ParseFlags(fs *flag.FlagSet, args []string) error {
+    jobName := ""
+    if len(args) >= 2 && args[0] == "run" {
+        jobName = args[1]
+        args = args[2:]
+    }
+
+    if err := fs.Parse(args); err != nil {
+        return err
+    }
+
+    // Flags of the command line override the file
+    set := map[string]bool{}
+    fs.Visit(func(f *flag.Flag) {
+        set[f.Name] = true
+    })
+    if jobName == "" && !set["config"] {
+        return nil
+    }
+
+    config, err := LoadConfig(fs.Lookup("config").Value.String())
+    if err != nil {
+        return err
+    }
+
+    if jobName != "" {
+        if err = ApplyJob(fs, config, jobName, set); err != nil {
+            return err
+        }
+    }
+
+    for _, name := range []string{"conn", "targetConn", "sfConn"} {
+        if f := fs.Lookup(name); f != nil {
+            if conn, ok := config.Connections[f.Value.String()]; ok {
+                fs.Set(name, conn)
+            }
+        }
+    }
+
+    return nil
+}
+
+// ApplyJob sets the flags of the job and its profile that are not set on the command line
+func ApplyJob(fs *flag.FlagSet, config *Config, jobName string, set map[string]bool) error {
+    job, ok := config.Jobs[jobName]
+    if !ok {
+        return fmt.Errorf("Job %s is not in the configuration file", jobName)
+    }
+
+    // Profile values, then job values
+    values := map[string]interface{}{}
+    if name, ok := job["profile"]; ok {
+        profile, ok := config.Profiles[fmt.Sprint(name)]
+        if !ok {
+            return fmt.Errorf("Profile %v of job %s is not in the configuration file", name, jobName)
+        }
+        for k, v := range profile {
+            values[k] = v
+        }
+    }
+    for k, v := range job {
+        if k != "profile" {
+            values[k] = v
+        }
+    }
+
+    for name, value := range values {
+        if fs.Lookup(name) == nil {
+            return fmt.Errorf("Unknown parameter %s in job %s", name, jobName)
+        }
+
+        // Variables as a map or a list of key=value, variables of the command line override the file
+        if vars, ok := fs.Lookup(name).Value.(Vars); ok {
+            items := Vars{}
+            switch v := value.(type) {
+            case map[string]interface{}:
+                for key, item := range v {
+                    items[key] = fmt.Sprint(item)
+                }
+            case []interface{}:
+                for _, item := range v {
+                    if err := items.Set(fmt.Sprint(item)); err != nil {
+                        return fmt.Errorf("Job %s, parameter %s: %v", jobName, name, err)
+                    }
+                }
+            default:
+                if err := items.Set(fmt.Sprint(v)); err != nil {
+                    return fmt.Errorf("Job %s, parameter %s: %v", jobName, name, err)
+                }
+            }
+            for key, item := range items {
+                if _, ok := vars[key]; !ok {
+                    vars[key] = item
+                }
+            }
+            continue
+        }
+
+        if set[name] {
+            continue
+        }
+
+        // Lists as comma-separated values, like -ddl=oracle,snowflake
+        str := fmt.Sprint(value)
+        if list, ok := value.([]interface{}); ok {
+            items := make([]string, len(list))
+            for i, item := range list {
+                items[i] = fmt.Sprint(item)
+            }
+            str = strings.Join(items, ",")
+        }
+        if err := fs.Set(name, str); err != nil {
+            return fmt.Errorf("Job %s, parameter %s: %v", jobName, name, err)
+        }
+    }
+
+    return nil
+}
+
+func LoadConfig(fileName string) (*Config, error) {
+    content, err := ioutil.ReadFile(fileName)
+    if err != nil {
+        return nil, err
+    }
+
+    config := &Config{}
+    if err = yaml.Unmarshal(content, config); err != nil {
+        return nil, fmt.Errorf("%s: %v", fileName, err)
+    }
+    return config, nil
+}
+
+// BatchQueryFiles lists .sql files of the directory and files of the list
+func BatchQueryFiles(queryDir string, queryList string) ([]string, error) {
+    files := []string{}
+
+    if queryDir != "" {
+        matches, err := filepath.Glob(filepath.Join(queryDir, "*.sql"))
+        if err != nil {
+            return nil, err
+        }
+        files = append(files, matches...)
+    }
+
+    if queryList != "" {
+        content, err := ioutil.ReadFile(queryList)
+        if err != nil {
+            return nil, err
+        }
+        for _, line := range strings.Split(string(content), "\n") {
+            line = strings.TrimSpace(line)
+            if line != "" && !strings.HasPrefix(line, "#") {
+                files = append(files, line)
+            }
+        }
+    }
+
+    if len(files) == 0 {
+        return nil, fmt.Errorf("No query files")
+    }
+    return files, nil
+}
+
+// RunBatch exports every query file with a shared pool of workers connections.
+// Output names are the query file names without extension, in the -fname directory if it is set
+func RunBatch(params Params, queryFiles []string, workers int) []BatchResult {
+    results := make([]BatchResult, len(queryFiles))
+
+    Log("... Setting up Database Connection")
+    db, err := ConnectToDB(params.ConnStr)
+    if err != nil {
+        Log("... DB Setup Failed")
+        for i, queryFile := range queryFiles {
+            results[i] = BatchResult{Name: queryFile, Err: err}
+        }
+        return results
+    }
+    defer db.Close()
+
+    db.SetMaxOpenConns(workers)
+    db.SetMaxIdleConns(workers)
+
+    // Read query files
+    queries := make([]QueryFile, len(queryFiles))
+    snapshot := false
+    for i, queryFile := range queryFiles {
+        content, err := ioutil.ReadFile(queryFile)
+        rendered := ""
+        if err == nil {
+            rendered, err = RenderQuery(string(content), params.Vars)
+        }
+        if err == nil {
+            queries[i], err = ParseQueryFile(rendered)
+        }
+        if err != nil {
+            results[i] = BatchResult{Name: queryFile, Err: err}
+            continue
+        }
+        snapshot = snapshot || UsesBind(queries[i].Query, "snapshot_scn")
+    }
+
+    // One snapshot SCN for all queries
+    if snapshot && params.Binds["snapshot_scn"] == nil {
+        scn, err := CurrentSCN(db)
+        if err != nil {
+            for i, queryFile := range queryFiles {
+                results[i] = BatchResult{Name: queryFile, Err: err}
+            }
+            return results
+        }
+        Log("... Snapshot SCN", scn)
+        params.Binds["snapshot_scn"] = scn
+    }
+
+    var w sync.WaitGroup
+    w.Add(workers)
+
+    // Make job channel
+    cJobs := make(chan int)
+
+    for p := 1; p <= workers; p++ {
+        go func(ciJobs <- chan int) {
+            defer w.Done()
+            for i := range ciJobs {
+                results[i] = RunBatchQuery(db, params, queryFiles[i], queries[i])
+            }
+        }(cJobs)
+    }
+
+    for i := range queryFiles {
+        if results[i].Err == nil {
+            cJobs <- i
+        }
+    }
+    close(cJobs)
+    w.Wait()
+
+    return results
+}
+
+// RunBatchQuery exports one query file in its own session, session statements of the file
+// are not kept in the pool
+func RunBatchQuery(db *sql.DB, params Params, fileName string, queryFile QueryFile) BatchResult {
+    result := BatchResult{Name: fileName}
+    start := time.Now()
+
+    params.Query = queryFile.Query
+    params.Pre = queryFile.Pre
+    params.Post = queryFile.Post
+    params.Manifest = &Manifest{}
+    if params.FileName == "-" {
+        params.FileName = TrimExtension(fileName)
+    } else {
+        params.FileName = filepath.Join(params.FileName, filepath.Base(TrimExtension(fileName)))
+        if err := os.MkdirAll(filepath.Dir(params.FileName), 0755); err != nil {
+            result.Err = err
+            result.Duration = time.Since(start)
+            return result
+        }
+    }
+    params.DDLTable = strings.ToUpper(filepath.Base(params.FileName))
+    params.SfTable = params.DDLTable
+
+    Log("...", fileName)
+    ctx := context.Background()
+    conn, err := SessionConn(ctx, db, queryFile.Session)
+    if err != nil {
+        result.Err = err
+        result.Duration = time.Since(start)
+        return result
+    }
+    defer func() {
+        if len(queryFile.Session) > 0 || len(queryFile.Pre) > 0 || len(queryFile.Post) > 0 {
+            DiscardConn(conn)
+        }
+        conn.Close()
+    }()
+
+    if result.Err = RunStatements(conn, params.Pre, params.Binds); result.Err == nil {
+        UnloadQuery(conn, params)
+        result.Err = FinishExport(params)
+    }
+    if result.Err == nil {
+        result.Err = RunStatements(conn, params.Post, ExportBinds(params))
+    }
+
+    for _, ef := range params.Manifest.Files {
+        result.Rows += ef.Rows
+        result.Files++
+    }
+    result.Duration = time.Since(start)
+
+    return result
+}
+
+// PrintBatchSummary prints the result of every query, returns the number of failed queries
+func PrintBatchSummary(results []BatchResult) int {
+    failed := 0
+    rows := 0
+    files := 0
+
+    Log()
+    fmt.Fprintf(logOut, "%-40s %12s %6s %12s  %s\n", "QUERY", "ROWS", "FILES", "DURATION", "ERROR")
+    for _, r := range results {
+        errText := ""
+        if r.Err != nil {
+            errText = r.Err.Error()
+            failed++
+        }
+        rows += r.Rows
+        files += r.Files
+        fmt.Fprintf(logOut, "%-40s %12d %6d %12s  %s\n", r.Name, r.Rows, r.Files, r.Duration.Round(time.Millisecond), errText)
+    }
+    fmt.Fprintf(logOut, "%-40s %12d %6d\n", "TOTAL", rows, files)
+
+    if failed > 0 {
+        Log("...", failed, "of", len(results), "queries failed")
+    }
+    return failed
+}
+
+// SplitList splits a comma-separated list, empty items are skipped
+func SplitList(list string) []string {
+    items := []string{}
+    for _, item := range strings.Split(list, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            items = append(items, item)
+        }
+    }
+    return items
+}
+
+// SupportedDataType checks a DATA_TYPE of ALL_TAB_COLUMNS, like TIMESTAMP(6) WITH TIME ZONE
+func SupportedDataType(dataType string) bool {
+    switch regexp.MustCompile(`\(\d+\)`).ReplaceAllString(dataType, "") {
+    case "NUMBER", "FLOAT", "VARCHAR2", "NVARCHAR2", "CHAR", "NCHAR", "CLOB", "NCLOB",
+         "DATE", "TIMESTAMP", "TIMESTAMP WITH TIME ZONE", "TIMESTAMP WITH LOCAL TIME ZONE":
+        return true
+    }
+    return false
+}
+
+// SchemaTables lists tables of the schema matching include and not matching exclude LIKE patterns,
+// with supported columns and the range column: a single-column integer primary key
+func SchemaTables(db *sql.DB, schema string, include []string, exclude []string) ([]SchemaTable, error) {
+    query := "select table_name from all_tables where owner = :1 and nested = 'NO' and secondary = 'N' and temporary = 'N'"
+    args := []interface{}{schema}
+
+    if len(include) > 0 {
+        like := []string{}
+        for _, pattern := range include {
+            args = append(args, pattern)
+            like = append(like, fmt.Sprintf("table_name like :%d escape '\\'", len(args)))
+        }
+        query += " and (" + strings.Join(like, " or ") + ")"
+    }
+    for _, pattern := range exclude {
+        args = append(args, pattern)
+        query += fmt.Sprintf(" and table_name not like :%d escape '\\'", len(args))
+    }
+    query += " order by table_name"
+
+    rows, err := db.Query(query, args...)
+    if err != nil {
+        return nil, err
+    }
+    tables := []SchemaTable{}
+    for rows.Next() {
+        var t SchemaTable
+        if err = rows.Scan(&t.Name); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        tables = append(tables, t)
+    }
+    rows.Close()
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    for i := range tables {
+        if tables[i].Columns, err = TableColumns(db, schema, tables[i].Name); err != nil {
+            return nil, err
+        }
+        if tables[i].RangeColumn, err = RangeColumn(db, schema, tables[i].Name); err != nil {
+            return nil, err
+        }
+    }
+
+    return tables, nil
+}
+
+// TableColumns lists columns of the table with supported types
+func TableColumns(db *sql.DB, schema string, table string) ([]string, error) {
+    rows, err := db.Query(`select column_name, data_type from all_tab_columns
+                            where owner = :1 and table_name = :2 order by column_id`, schema, table)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    columns := []string{}
+    for rows.Next() {
+        var name, dataType string
+        if err = rows.Scan(&name, &dataType); err != nil {
+            return nil, err
+        }
+        if !SupportedDataType(dataType) {
+            Log("...", table + "." + name, "skipped, unsupported type", dataType)
+            continue
+        }
+        columns = append(columns, name)
+    }
+    return columns, rows.Err()
+}
+
+// RangeColumn returns the single-column primary key of the table if it is an integer NUMBER
+func RangeColumn(db *sql.DB, schema string, table string) (string, error) {
+    rows, err := db.Query(`select cc.column_name
+                             from all_constraints c
+                             join all_cons_columns cc on cc.owner = c.owner and cc.constraint_name = c.constraint_name
+                             join all_tab_columns tc on tc.owner = cc.owner and tc.table_name = cc.table_name and tc.column_name = cc.column_name
+                            where c.owner = :1 and c.table_name = :2 and c.constraint_type = 'P'
+                              and tc.data_type = 'NUMBER' and tc.data_scale = 0
+                              and (select count(*) from all_cons_columns k
+                                    where k.owner = c.owner and k.constraint_name = c.constraint_name) = 1`, schema, table)
+    if err != nil {
+        return "", err
+    }
+    defer rows.Close()
+
+    column := ""
+    if rows.Next() {
+        if err = rows.Scan(&column); err != nil {
+            return "", err
+        }
+    }
+    return column, rows.Err()
+}
+
+// TableQuery builds the query of the table, with the range condition if it has a range column
+func TableQuery(schema string, table SchemaTable) string {
+    columns := make([]string, len(table.Columns))
+    for i, c := range table.Columns {
+        columns[i] = QuoteIdentifier("oracle", c)
+    }
+
+    query := "select " + strings.Join(columns, ", ") +
+             " from " + QuoteIdentifier("oracle", schema) + "." + QuoteIdentifier("oracle", table.Name)
+    if table.RangeColumn != "" {
+        query += " where " + QuoteIdentifier("oracle", table.RangeColumn) + " between :1 and :2"
+    }
+    return query
+}
+
+// TableRange returns the minimum and maximum of the range column, ok is false for an empty table
+func TableRange(db *sql.DB, schema string, table SchemaTable) (rangeStart int, rangeEnd int, ok bool, err error) {
+    column := QuoteIdentifier("oracle", table.RangeColumn)
+    var first, last sql.NullInt64
+    err = db.QueryRow("select min(" + column + "), max(" + column + ") from " +
+                      QuoteIdentifier("oracle", schema) + "." + QuoteIdentifier("oracle", table.Name)).Scan(&first, &last)
+    if err != nil || !first.Valid {
+        return 0, 0, false, err
+    }
+    return int(first.Int64), int(last.Int64), true, nil
+}
+
+// ExportSchema exports every table of the schema to <fname>/<TABLE>/<TABLE>_*, the default directory is the schema name.
+// Tables with a range column are exported by ranges of batchSize in parallel threads
+func ExportSchema(params Params, schema string, include []string, exclude []string, batchSize int, parallel int) []BatchResult {
+    Log("... Setting up Database Connection")
+    db, err := ConnectToDB(params.ConnStr)
+    if err != nil {
+        Log("... DB Setup Failed")
+        return []BatchResult{BatchResult{Name: schema, Err: err}}
+    }
+    defer db.Close()
+
+    tables, err := SchemaTables(db, schema, include, exclude)
+    if err != nil {
+        return []BatchResult{BatchResult{Name: schema, Err: err}}
+    }
+    Log("...", len(tables), "tables in", schema)
+
+    dir := params.FileName
+    if dir == "-" {
+        dir = schema
+    }
+
+    results := []BatchResult{}
+    for _, table := range tables {
+        result := BatchResult{Name: table.Name}
+        start := time.Now()
+
+        p := params
+        p.FileName = filepath.Join(dir, table.Name, table.Name)
+        p.Manifest = &Manifest{}
+        p.DDLTable = table.Name
+        p.SfTable = table.Name
+        p.Query = TableQuery(schema, table)
+
+        result.Err = ExportSchemaTable(db, p, schema, table, batchSize, parallel)
+
+        for _, ef := range p.Manifest.Files {
+            result.Rows += ef.Rows
+            result.Files++
+        }
+        result.Duration = time.Since(start)
+        results = append(results, result)
+    }
+
+    return results
+}
+
+// ExportSchemaTable exports one table of the schema and finishes its export
+func ExportSchemaTable(db *sql.DB, params Params, schema string, table SchemaTable, batchSize int, parallel int) error {
+    if len(table.Columns) == 0 {
+        return fmt.Errorf("No supported columns")
+    }
+    if err := os.MkdirAll(filepath.Dir(params.FileName), 0755); err != nil {
+        return err
+    }
+
+    Log("...", table.Name)
+    if table.RangeColumn != "" {
+        rangeStart, rangeEnd, ok, err := TableRange(db, schema, table)
+        if err != nil {
+            return err
+        }
+        if ok {
+            Log("... range column", table.RangeColumn, rangeStart, rangeEnd)
+            RunUnloadTableByRange(params, rangeStart, rangeEnd, batchSize, parallel)
+            return FinishExport(params)
+        }
+
+        // Empty table
+        table.RangeColumn = ""
+        params.Query = TableQuery(schema, table)
+    }
+
+    conn, err := SessionConn(context.Background(), db, nil)
+    if err != nil {
+        return err
+    }
+    UnloadQuery(conn, params)
+    conn.Close()
+
+    return FinishExport(params)
+}
+
+// String and Set implement flag.Value
+func (v Vars) String() string {
+    items := []string{}
+    for key, value := range v {
+        items = append(items, key + "=" + value)
+    }
+    sort.Strings(items)
+    return strings.Join(items, ",")
+}
+
+func (v Vars) Set(s string) error {
+    kv := strings.SplitN(s, "=", 2)
+    if len(kv) != 2 || kv[0] == "" {
+        return fmt.Errorf("Variable must be key=value: %s", s)
+    }
+    v[kv[0]] = kv[1]
+    return nil
+}
+
+// RenderQuery replaces ${NAME} with the variable NAME, then executes the query as a text/template
+// with the variables, like {{.LoadDate}}. Only variables set with -var or in the configuration are
+// used, a variable that is not set is an error
+func RenderQuery(query string, vars Vars) (string, error) {
+    var err error
+    query = queryVar.ReplaceAllStringFunc(query, func(m string) string {
+        name := queryVar.FindStringSubmatch(m)[1]
+        if value, ok := vars[name]; ok {
+            return value
+        }
+        if err == nil {
+            err = fmt.Errorf("Variable %s is not set, set it with -var %s=<value>", name, name)
+        }
+        return m
+    })
+    if err != nil {
+        return "", err
+    }
+
+    if !strings.Contains(query, "{{") {
+        return query, nil
+    }
+
+    t, err := template.New("query").Option("missingkey=error").Parse(query)
+    if err != nil {
+        return "", err
+    }
+    var b strings.Builder
+    if err = t.Execute(&b, map[string]string(vars)); err != nil {
+        return "", err
+    }
+    return b.String(), nil
+}
+
+// UsesBind checks if the query has the named bind variable
+func UsesBind(query string, name string) bool {
+    for _, m := range namedBind.FindAllStringSubmatch(query, -1) {
+        if strings.EqualFold(m[1], name) {
+            return true
+        }
+    }
+    return false
+}
+
+// QueryArgs returns named arguments of the binds used in the query
+func QueryArgs(query string, binds map[string]interface{}) []interface{} {
+    args := []interface{}{}
+    used := map[string]bool{}
+    for _, m := range namedBind.FindAllStringSubmatch(query, -1) {
+        name := strings.ToLower(m[1])
+        if value, ok := binds[name]; ok && !used[name] {
+            args = append(args, sql.Named(m[1], value))
+            used[name] = true
+        }
+    }
+    return args
+}
+
+// RangeArgs binds the range to :range_start and :range_end,
+// or to positional :1 and :2 if the query has no named binds
+func RangeArgs(params Params, r Range) []interface{} {
+    binds := map[string]interface{}{"range_start": r.FirstValue, "range_end": r.LastValue}
+    for name, value := range params.Binds {
+        binds[name] = value
+    }
+
+    args := QueryArgs(params.Query, binds)
+    if len(args) == 0 {
+        args = []interface{}{r.FirstValue, r.LastValue}
+    }
+    return args
+}
+
+// CurrentSCN returns the current system change number
+func CurrentSCN(q Queryer) (string, error) {
+    rows, err := q.QueryContext(context.Background(), "select to_char(dbms_flashback.get_system_change_number) from dual")
+    if err != nil {
+        return "", err
+    }
+    defer rows.Close()
+
+    scn := ""
+    if rows.Next() {
+        err = rows.Scan(&scn)
+    }
+    if err == nil {
+        err = rows.Err()
+    }
+    return scn, err
+}
+
+// SnapshotSCN binds the current SCN to :snapshot_scn, so all connections read the same snapshot
+func SnapshotSCN(params Params) error {
+    db, err := ConnectToDB(params.ConnStr)
+    if err != nil {
+        return err
+    }
+    defer db.Close()
+
+    scn, err := CurrentSCN(db)
+    if err != nil {
+        return err
+    }
+    Log("... Snapshot SCN", scn)
+    params.Binds["snapshot_scn"] = scn
+    return nil
+}
+
+// LoadWatermark reads the state file, the watermark is nil if the file does not exist
+func LoadWatermark(fileName string) (*Watermark, error) {
+    content, err := ioutil.ReadFile(fileName)
+    if os.IsNotExist(err) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    w := &Watermark{}
+    if err = json.Unmarshal(content, w); err != nil {
+        return nil, fmt.Errorf("%s: %v", fileName, err)
+    }
+    return w, nil
+}
+
+// SaveWatermark replaces the state file, so the state is either old or new
+func SaveWatermark(fileName string, w *Watermark) error {
+    content, err := json.MarshalIndent(w, "", "  ")
+    if err != nil {
+        return err
+    }
+    if err = ioutil.WriteFile(fileName + ".tmp", append(content, '\n'), 0644); err != nil {
+        return err
+    }
+    return os.Rename(fileName + ".tmp", fileName)
+}
+
+// WatermarkBind converts the watermark value to a bind value, an empty value is the lowest value
+func WatermarkBind(watermarkType string, value string) (interface{}, error) {
+    if watermarkType == "timestamp" {
+        if value == "" {
+            return time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), nil
+        }
+        return time.Parse(time.RFC3339Nano, value)
+    }
+    if value == "" {
+        return -1e125, nil
+    }
+    return value, nil
+}
+
+// WatermarkName is a part of the file names, like 20240131T235959 or 1500
+func WatermarkName(watermarkType string, value string) string {
+    if value == "" {
+        return "begin"
+    }
+    if watermarkType == "timestamp" {
+        t, err := time.Parse(time.RFC3339Nano, value)
+        if err == nil {
+            return t.Format("20060102T150405")
+        }
+    }
+    return strings.NewReplacer(".", "p", "-", "m").Replace(value)
+}
+
+// StartIncremental binds the last watermark to :watermark_start and the maximum value
+// of the column to :watermark_end, and adds the interval to the file name.
+// The new watermark is nil if there are no new rows
+func StartIncremental(params *Params, column string, watermarkType string, stateFileName string, binds map[string]interface{}) (*Watermark, error) {
+    if watermarkType != "number" && watermarkType != "timestamp" {
+        return nil, fmt.Errorf("Unknown watermark type: %s", watermarkType)
+    }
+    if !UsesBind(params.Query, "watermark_start") || !UsesBind(params.Query, "watermark_end") {
+        return nil, fmt.Errorf("Incremental query must use :watermark_start and :watermark_end")
+    }
+
+    last, err := LoadWatermark(stateFileName)
+    if err != nil {
+        return nil, err
+    }
+    start := ""
+    if last != nil {
+        if !strings.EqualFold(last.Column, column) || last.Type != watermarkType {
+            return nil, fmt.Errorf("%s is the state of %s %s", stateFileName, last.Column, last.Type)
+        }
+        start = last.Value
+    }
+
+    startBind, err := WatermarkBind(watermarkType, start)
+    if err != nil {
+        return nil, err
+    }
+    endBind := interface{}(1e125)
+    if watermarkType == "timestamp" {
+        endBind = time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+    }
+
+    for name, value := range params.Binds {
+        binds[name] = value
+    }
+    binds["watermark_start"] = startBind
+    binds["watermark_end"] = endBind
+
+    // Maximum value of the column after the last watermark
+    Log("... Reading watermark of", column, "after", WatermarkName(watermarkType, start))
+    db, err := ConnectToDB(params.ConnStr)
+    if err != nil {
+        return nil, err
+    }
+    defer db.Close()
+
+    // The query runs with the session statements, like the export
+    conn, err := SessionConn(context.Background(), db, nil)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    return ReadWatermark(conn, params, column, watermarkType, start, binds)
+}
+
+// ReadWatermark reads the maximum value of the column with the binds of StartIncremental,
+// binds the interval of the export and adds it to the file name
+func ReadWatermark(q Queryer, params *Params, column string, watermarkType string, start string, binds map[string]interface{}) (*Watermark, error) {
+    maxValue := "max(" + QuoteIdentifier("oracle", strings.ToUpper(column)) + ")"
+    if watermarkType == "number" {
+        maxValue = "to_char(" + maxValue + ")"
+    }
+    maxQuery := "select " + maxValue + " from (" + params.Query + ")"
+
+    rows, err := q.QueryContext(context.Background(), maxQuery, QueryArgs(maxQuery, binds)...)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    var value interface{}
+    if rows.Next() {
+        err = rows.Scan(&value)
+    }
+    if err == nil {
+        err = rows.Err()
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    w := &Watermark{Column: column, Type: watermarkType, Start: start, Files: []string{}, Time: time.Now().UTC()}
+    switch v := value.(type) {
+    case nil:
+        return nil, nil
+    case time.Time:
+        w.Value = v.Format(time.RFC3339Nano)
+        params.Binds["watermark_end"] = v
+    case string:
+        w.Value = v
+        params.Binds["watermark_end"] = v
+    default:
+        return nil, fmt.Errorf("Unexpected type of watermark %s: %T", column, value)
+    }
+    params.Binds["watermark_start"] = binds["watermark_start"]
+
+    // Files are named with the watermark interval
+    params.FileName += "_" + WatermarkName(watermarkType, start) + "_" + WatermarkName(watermarkType, w.Value)
+
+    return w, nil
+}
 
-    // Check and read password
-    params.ConnStr, err = ReadPassword(params.ConnStr)
+// ParseQueryFile splits a query file into sections marked with -- @session, -- @pre, -- @query and -- @post.
+// A file without sections is the query
+func ParseQueryFile(text string) (QueryFile, error) {
+    qf := QueryFile{}
+    sections := map[string][]string{}
+    section := ""
+    for _, line := range strings.Split(text, "\n") {
+        if m := sectionMarker.FindStringSubmatch(strings.TrimRight(line, "\r")); m != nil {
+            section = strings.ToLower(m[1])
+            continue
+        }
+        sections[section] = append(sections[section], line)
+    }
+    if section == "" {
+        qf.Query = text
+        return qf, nil
+    }
 
-    if err != nil {
-        fmt.Println(err)
-        return
+    if len(SplitStatements(strings.Join(sections[""], "\n"))) > 0 {
+        return qf, fmt.Errorf("Statements before the first section")
     }
+    qf.Session = SplitStatements(strings.Join(sections["session"], "\n"))
+    qf.Pre = SplitStatements(strings.Join(sections["pre"], "\n"))
+    qf.Post = SplitStatements(strings.Join(sections["post"], "\n"))
 
-    // Generate file name
-    if params.FileName == "-" {
-        params.FileName = TrimExtension(*queryFileName)
+    query := SplitStatements(strings.Join(sections["query"], "\n"))
+    if len(query) != 1 {
+        return qf, fmt.Errorf("The query section must have one query, %d found", len(query))
     }
+    qf.Query = query[0]
 
-    // Read range
-    if *rangeStart != "-" && *rangeEnd != "-" {
-        rs, err := strconv.Atoi(*rangeStart)
-        if err != nil {
-            fmt.Println(err)
-            return
+    return qf, nil
+}
+
+// SplitStatements splits statements like SQL*Plus: SQL statements end with ; at the end of a line,
+// before a -- comment and outside of quotes, PL/SQL blocks end with a line of /
+func SplitStatements(text string) []string {
+    statements := []string{}
+    lines := []string{}
+    var quoted byte
+    flush := func() {
+        if stmt := strings.TrimSpace(strings.Join(lines, "\n")); stmt != "" {
+            statements = append(statements, stmt)
         }
-        re, err := strconv.Atoi(*rangeEnd)
-        if err != nil {
-            fmt.Println(err)
-            return
+        lines = lines[:0]
+        quoted = 0
+    }
+
+    for _, line := range strings.Split(text, "\n") {
+        line = strings.TrimRight(line, " \t\r")
+        trimmed := strings.TrimSpace(line)
+        if len(lines) == 0 && (trimmed == "" || strings.HasPrefix(trimmed, "--")) {
+            continue
+        }
+        if trimmed == "/" && quoted == 0 {
+            flush()
+            continue
         }
 
-        RunUnloadTableByRange(params, rs, re, *batchSize, *parallel)
+        lines = append(lines, line)
+        var code string
+        code, quoted = StripComment(line, quoted)
+        code = strings.TrimRight(code, " \t")
+        if quoted == 0 && strings.HasSuffix(code, ";") && !plsqlBlock.MatchString(strings.Join(lines, "\n")) {
+            lines[len(lines) - 1] = strings.TrimSuffix(code, ";")
+            flush()
+        }
+    }
+    flush()
 
-    } else {
-        UnloadTable(params)
+    return statements
+}
+
+// StripComment removes a -- comment from the end of the line. quoted is the quote of a literal
+// or identifier open at the start of the line, the quote open at the end is returned
+func StripComment(line string, quoted byte) (string, byte) {
+    for i := 0; i < len(line); i++ {
+        c := line[i]
+        switch {
+        case quoted != 0:
+            if c == quoted {
+                quoted = 0
+            }
+        case c == '\'' || c == '"':
+            quoted = c
+        case c == '-' && i + 1 < len(line) && line[i + 1] == '-':
+            return line[:i], 0
+        }
     }
+    return line, quoted
 }
 
-func ReadPassword(connStr string) (string, error) {
-    re, err := regexp.Compile(".+/{1}.+@{1}")
+// ReadStatements reads statements of a companion file, no file has no statements
+func ReadStatements(fileName string, vars Vars) ([]string, error) {
+    if fileName == "" {
+        return nil, nil
+    }
+
+    content, err := ioutil.ReadFile(fileName)
     if err != nil {
-        return "", err
+        return nil, err
+    }
+    text, err := RenderQuery(string(content), vars)
+    if err != nil {
+        return nil, err
     }
+    return SplitStatements(text), nil
+}
 
-    if re.MatchString(connStr) {
-        return connStr, nil
+// RunStatements executes statements with the named binds they use
+func RunStatements(e Execer, statements []string, binds map[string]interface{}) error {
+    for _, stmt := range statements {
+        Log("...", strings.SplitN(stmt, "\n", 2)[0])
+        if _, err := e.ExecContext(context.Background(), stmt, QueryArgs(stmt, binds)...); err != nil {
+            return fmt.Errorf("%s: %v", stmt, err)
+        }
     }
+    return nil
+}
 
-    newConnStr := connStr;
+// RunHooks executes pre-export or post-export statements in the session of the export,
+// or in a separate session if there is none (ranges, batch and schema mode)
+func RunHooks(params Params, session *sql.Conn, statements []string, binds map[string]interface{}) error {
+    if len(statements) == 0 {
+        return nil
+    }
+    if session != nil {
+        return RunStatements(session, statements, binds)
+    }
 
-    fmt.Print("Enter password: ")
-    bytePassword, err := terminal.ReadPassword(int(syscall.Stdin))
+    db, err := ConnectToDB(params.ConnStr)
     if err != nil {
-        return "", err
+        return err
     }
+    defer db.Close()
 
-    fmt.Println("")
-
-    re, err = regexp.Compile("@")
+    conn, err := SessionConn(context.Background(), db, nil)
     if err != nil {
-        return "", err
+        return err
     }
-    newConnStr = re.ReplaceAllString(newConnStr, fmt.Sprintf("/%s@", string(bytePassword)))
+    defer conn.Close()
 
-    return newConnStr, nil
+    return RunStatements(conn, statements, binds)
 }
 
-func NullFloat64ToString(v sql.NullFloat64) string {
-    if !v.Valid {
-        return ""
+// ExportBinds adds :row_count and :file_count of the export to the binds
+func ExportBinds(params Params) map[string]interface{} {
+    rows := 0
+    for _, ef := range params.Manifest.Files {
+        rows += ef.Rows
     }
-    return strconv.FormatFloat(v.Float64, 'f', -1, 64)
+    return WithBinds(params.Binds, rows, len(params.Manifest.Files))
 }
 
-func NullStringToString(v sql.NullString) string {
-    if !v.Valid {
-        return ""
+// BatchBinds adds :row_count and :file_count of all queries to the binds
+func BatchBinds(params Params, results []BatchResult) map[string]interface{} {
+    rows := 0
+    files := 0
+    for _, r := range results {
+        rows += r.Rows
+        files += r.Files
     }
-    return v.String
+    return WithBinds(params.Binds, rows, files)
 }
 
-func NullTimeToString(v sql.NullTime, columnType string) string {
-    if !v.Valid {
-        return ""
+func WithBinds(binds map[string]interface{}, rows int, files int) map[string]interface{} {
+    result := map[string]interface{}{"row_count": rows, "file_count": files}
+    for name, value := range binds {
+        result[name] = value
     }
+    return result
+}
 
-    switch columnType {
-    case "DATE":
-        return v.Time.Format("2006-01-02 15:04:05")
-    case "TIMESTAMP":
-        return v.Time.Format("2006-01-02 15:04:05.000000000")
-    case "TIMESTAMP WITH TIME ZONE":
-        return v.Time.Format("2006-01-02 15:04:05.000000000 -0700")
-    case "TIMESTAMP WITH LOCAL TIME ZONE":
-        return v.Time.Format("2006-01-02 15:04:05.000000000")
-    }
-    return ""
+// DiscardConn closes the connection instead of returning it to the pool
+func DiscardConn(conn *sql.Conn) {
+    conn.Raw(func(driverConn interface{}) error {
+        return driver.ErrBadConn
+    })
 }
 
-func ToString(i interface{}, columnType string) string {
-    switch fmt.Sprintf("%T", i) {
-    case "*sql.NullFloat64":
-        return NullFloat64ToString(*i.(*sql.NullFloat64))
-    case "*sql.NullString":
-        return NullStringToString(*i.(*sql.NullString))
-    case "*sql.NullTime":
-        return NullTimeToString(*i.(*sql.NullTime), columnType)
+// Scan implements sql.Scanner, a LOB locator is read to the end
+func (l *LobString) Scan(src interface{}) error {
+    if r, ok := src.(io.Reader); ok {
+        b, err := ioutil.ReadAll(r)
+        if err != nil {
+            return err
+        }
+        l.String, l.Valid = string(b), true
+        return nil
     }
-    return ""
+    return l.NullString.Scan(src)
 }
 
-func DefineColumnTypes(rows *sql.Rows) (columnTypes []*sql.ColumnType, row []interface{}, err error) {
-    columnTypes, err = rows.ColumnTypes()
-    if err != nil {
-    	return
+// FetchOptions returns godror query options, zero values keep the defaults of the driver
+func FetchOptions(arraySize int, prefetchRows int, lobPrefetch bool) []interface{} {
+    options := []interface{}{}
+    if arraySize > 0 {
+        options = append(options, godror.FetchArraySize(arraySize))
     }
+    if prefetchRows > 0 {
+        options = append(options, godror.PrefetchCount(prefetchRows))
+    }
+    if lobPrefetch {
+        options = append(options, godror.ClobAsString())
+    } else {
+        options = append(options, godror.LobAsReader())
+    }
+    return options
+}
 
-    for _, c := range columnTypes {
-        if c.DatabaseTypeName() == "NUMBER" {
-            //row = append(row, &sql.NullFloat64{0, false})
-            row = append(row, &sql.NullString{"", false})
-        } else if c.DatabaseTypeName() == "VARCHAR2" || c.DatabaseTypeName() == "NVARCHAR2" || c.DatabaseTypeName() == "CLOB" || c.DatabaseTypeName() == "NCLOB" {
-            row = append(row, &sql.NullString{"", false})
-        } else if c.DatabaseTypeName() == "DATE" || c.DatabaseTypeName() == "TIMESTAMP" || c.DatabaseTypeName() == "TIMESTAMP WITH TIME ZONE" || c.DatabaseTypeName() == "TIMESTAMP WITH LOCAL TIME ZONE" {
-            row = append(row, &sql.NullTime {time.Time{}, false})
-        } else {
-        	err = fmt.Errorf("Unexpected type: %s ", c.DatabaseTypeName())
+// ParseInts parses a comma-separated list of numbers
+func ParseInts(list string) ([]int, error) {
+    values := []int{}
+    for _, item := range SplitList(list) {
+        v, err := strconv.Atoi(item)
+        if err != nil {
+            return nil, err
         }
+        values = append(values, v)
     }
-
-    return
+    return values, nil
 }
 
-func UnloadTable(params Params) {
-    fmt.Println("... Setting up Database Connection")
+// BenchmarkFetch fetches all rows of the query with every fetch array size and prefetch rows,
+// rows are converted to text as in the export but not written
+func BenchmarkFetch(params Params, arraySizes []int, prefetch []int, lobPrefetch bool) []BenchResult {
+    results := []BenchResult{}
+
+    Log("... Setting up Database Connection")
     db, err := ConnectToDB(params.ConnStr)
     if err != nil {
-        fmt.Println("... DB Setup Failed")
-        fmt.Println(err)
-        return
+        Log("... DB Setup Failed")
+        return append(results, BenchResult{Err: err})
     }
     defer db.Close()
 
-    // Exec query
-    rows, err := db.Query(params.Query)
+    conn, err := SessionConn(context.Background(), db, nil)
     if err != nil {
-        fmt.Println("... Error processing query")
-        fmt.Println(err)
-        return
+        return append(results, BenchResult{Err: err})
     }
+    defer conn.Close()
 
-    // Define column types
-    columnTypes, row, err := DefineColumnTypes(rows)
+    for _, arraySize := range arraySizes {
+        for _, p := range prefetch {
+            Log("... Fetch array size", arraySize, "prefetch rows", p)
+            params.FetchOptions = FetchOptions(arraySize, p, lobPrefetch)
+            result := BenchmarkQuery(conn, params)
+            result.ArraySize = arraySize
+            result.Prefetch = p
+            results = append(results, result)
+        }
+    }
+
+    return results
+}
+
+func BenchmarkQuery(q Queryer, params Params) BenchResult {
+    result := BenchResult{}
+    start := time.Now()
+
+    rows, err := q.QueryContext(context.Background(), params.Query, append(QueryArgs(params.Query, params.Binds), params.FetchOptions...)...)
     if err != nil {
-        fmt.Println("... Error defining column types")
-        fmt.Println(err)
-        return
+        result.Err = err
+        return result
+    }
+    defer rows.Close()
+
+    _, row, formatters, err := DefineColumnTypes(rows, params.Format)
+    if err != nil {
+        result.Err = err
+        return result
     }
 
     var w sync.WaitGroup
     w.Add(1)
-    defer w.Wait()
-
-    // Make channel
-    cRows := make(chan []string)
-    defer close(cRows)
 
-    // Write to file
-    go func(params Params, ciRows <- chan []string) {
-        WriteToFile(0, params, params.MaxSizeMB, ciRows)
+    // Count rows
+    cRows := make(chan *RowBatch)
+    go func(ciRows <- chan *RowBatch) {
+        for batch := range ciRows {
+            result.Rows += batch.Rows
+            batch.Release()
+        }
         w.Done()
-    }(params, cRows)
+    }(cRows)
 
-    // Fetch rows
-    FetchRows(rows, row, columnTypes, params.DoubleQuotes, cRows)
+    _, _, result.Err = FetchRows(rows, row, formatters, params.Format, NewPipelineMetrics(), 0, cRows)
+    close(cRows)
+    w.Wait()
 
-    rows.Close()
+    result.Duration = time.Since(start)
 
-    fmt.Println("... Closing connection")
+    return result
 }
 
-func RunUnloadTableByRange(params Params, rangeStart int, rangeEnd int, batchSize int, parallel int) {
-    var w sync.WaitGroup
-    w.Add(parallel)
-    defer w.Wait()
-
-    // Make error channel
-    cError := make(chan error)
-    defer close(cError)
-
-    // Make range channel
-    cRange := make(chan Range)
-    defer close(cRange)
-
-    for p := 1; p <= parallel; p++ {
-        go func(rId int, params Params, ciRange <- chan Range, coError chan <- error) {
-            UnloadTableByRange(rId, params, ciRange, coError)
-            w.Done()
-        }(p, params, cRange, cError)
-    }
-
-    // Check errors
-    errors := []error{}
-    for p := 1; p <= parallel; p++ {
-        err := <- cError
-        if err != nil {
-            errors = append(errors, err)
+func PrintBenchSummary(results []BenchResult) {
+    Log()
+    fmt.Fprintf(logOut, "%10s %10s %12s %12s %12s  %s\n", "ARRAY SIZE", "PREFETCH", "ROWS", "DURATION", "ROWS/SEC", "ERROR")
+    for _, r := range results {
+        errText := ""
+        if r.Err != nil {
+            errText = r.Err.Error()
         }
-    }
-    if len(errors) > 0 {
-        for _, err := range errors {
-            fmt.Println(err)
+        rate := 0.0
+        if r.Duration > 0 {
+            rate = float64(r.Rows) / r.Duration.Seconds()
         }
-        return
+        fmt.Fprintf(logOut, "%10d %10d %12d %12s %12.0f  %s\n", r.ArraySize, r.Prefetch, r.Rows, r.Duration.Round(time.Millisecond), rate, errText)
     }
+}
+
+// StartPipeline starts the format workers and the writer of a connection
+func StartPipeline(rId int, params Params) *Pipeline {
+    p := &Pipeline{params: params, cRows: make(chan *RowBatch, params.PipelineBuffer)}
 
-    // Generation of ranges
-    for f := rangeStart; f <= rangeEnd; f += batchSize {
-        l := f + batchSize - 1;
-        if l > rangeEnd {
-            l = rangeEnd;
+    if params.FormatWorkers > 0 {
+        p.cRaw = make(chan *RawBatch, params.PipelineBuffer)
+        p.formatWG.Add(params.FormatWorkers)
+        for i := 0; i < params.FormatWorkers; i++ {
+            go func() {
+                defer p.formatWG.Done()
+                FormatRows(params, p.cRaw, p.cRows)
+            }()
         }
-        cRange <- Range{f, l}
     }
-}
 
-func UnloadTableByRange(rId int, params Params, ciRange <- chan Range, coError chan <- error) {
-    fmt.Println(rId, "... Setting up Database Connection")
-    db, err := ConnectToDB(params.ConnStr)
-    if err != nil {
-        coError <- err
-        return
+    // One writer, also for a stream
+    if params.Writers <= 1 || params.Stream != nil {
+        p.writerWG.Add(1)
+        go func() {
+            defer p.writerWG.Done()
+            WriteToFile(rId, 0, params, params.MaxSizeMB, p.cRows)
+        }()
+        return p
     }
-    defer db.Close()
 
-    // Error - Ok
-    coError <- nil
+    cWriters := make([]chan *RowBatch, params.Writers)
+    p.writerWG.Add(len(cWriters) + 1)
+    for i := range cWriters {
+        cWriters[i] = make(chan *RowBatch, params.PipelineBuffer)
+        go func(wId int, ciRows <- chan *RowBatch) {
+            defer p.writerWG.Done()
+            WriteToFile(rId, wId, params, params.MaxSizeMB, ciRows)
+        }(i + 1, cWriters[i])
+    }
+    go func() {
+        defer p.writerWG.Done()
+        DispatchRows(p.cRows, cWriters)
+    }()
 
-    var w sync.WaitGroup
-    w.Add(1)
-    defer w.Wait()
+    return p
+}
 
-    // Make channel
-    cRows := make(chan []string)
-    defer close(cRows)
+// DispatchRows deals the batches to the writers by Seq, so the writers get
+// the same share of rows and every writer keeps the order of its batches
+func DispatchRows(ciRows <- chan *RowBatch, cWriters []chan *RowBatch) {
+    for batch := range ciRows {
+        cWriters[batch.Seq % len(cWriters)] <- batch
+    }
+    for _, c := range cWriters {
+        close(c)
+    }
+}
 
-    // Write to file
-    go func(rId int, params Params, ciRows <- chan []string) {
-        WriteToFile(rId, params, params.MaxSizeMB, ciRows)
-        w.Done()
-    }(rId, params, cRows)
+// Fetch passes the rows of a query to the pipeline, the sequence of batches continues across queries.
+// Returns the number of rows and the error of the fetch
+func (p *Pipeline) Fetch(rows *sql.Rows, columnTypes []*sql.ColumnType, row []interface{}, formatters []Formatter) (int, error) {
+    var n int
+    var err error
+    if p.cRaw == nil {
+        p.seq, n, err = FetchRows(rows, row, formatters, p.params.Format, p.params.Metrics, p.seq, p.cRows)
+    } else {
+        p.seq, n, err = ScanRows(rows, columnTypes, formatters, p.params.Metrics, p.seq, p.cRaw)
+    }
+    return n, err
+}
 
-    // Get range
-    for r := range ciRange {
-        fmt.Println(rId, "range", r.FirstValue, r.LastValue)
+// Close waits for the format workers and the writer, all files are closed after Close
+func (p *Pipeline) Close() {
+    if p.cRaw != nil {
+        close(p.cRaw)
+        p.formatWG.Wait()
+    }
+    close(p.cRows)
+    p.writerWG.Wait()
+}
 
-        // Exec query
-        rows, err := db.Query(params.Query, r.FirstValue, r.LastValue)
-        if err != nil {
-            fmt.Println(rId, "... Error processing query", err)
-            return
+// ScanRows passes batches of scanned rows to the format workers, returns the sequence number of the next batch,
+// the number of rows and the error of a scan or of the fetch
+func ScanRows(rows *sql.Rows, columnTypes []*sql.ColumnType, formatters []Formatter, metrics *PipelineMetrics, seq int, coRaw chan <- *RawBatch) (int, int, error) {
+    // Scan values are reused by the batches of the query
+    pool := &sync.Pool{}
+    pool.New = func() interface{} {
+        batch := &RawBatch{Values: make([][]interface{}, BatchRows), Formatters: formatters, pool: pool}
+        for i := range batch.Values {
+            batch.Values[i], _ = NewScanRow(columnTypes)
         }
-
-        // Define column types
-	    columnTypes, row, err := DefineColumnTypes(rows)
-	    if err != nil {
-	    	fmt.Println(rId, "... Error defining column types", err)
-	        return
-	    }
-
-        // Fetch rows
-        FetchRows(rows, row, columnTypes, params.DoubleQuotes, cRows)
-
-        rows.Close()
+        return batch
     }
 
-    fmt.Println(rId, "... Closing connection")
-}
+    batch := pool.Get().(*RawBatch)
+    start := time.Now()
+    n := 0
 
-func ConnectToDB(connStr string) (db *sql.DB, err error) {
-    // Connect
-    db, err = sql.Open("godror", connStr)
-    if err != nil {
-        return nil, err
+    send := func() {
+        batch.Seq = seq
+        seq++
+        metrics.Fetch.Record(batch.Rows, 0, start)
+        metrics.Format.Queue(len(coRaw))
+        coRaw <- batch
     }
 
-    if err = db.Ping(); err != nil {
-        return nil, err
-    }
+    var err error
+    for rows.Next() {
+        if err = rows.Scan(batch.Values[batch.Rows]...); err != nil {
+            break
+        }
+        batch.Rows++
+        n++
 
-    if _, err = db.Exec("alter session set time_zone='UTC'"); err != nil {
-        return nil, err
+        if batch.Rows == len(batch.Values) {
+            send()
+            batch = pool.Get().(*RawBatch)
+            start = time.Now()
+        }
     }
-
-    if _, err = db.Exec("alter session set NLS_NUMERIC_CHARACTERS = '. '"); err != nil {
-        return nil, err
+    if err == nil {
+        err = rows.Err()
     }
 
-    return db, nil
+    if batch.Rows > 0 {
+        send()
+    } else {
+        batch.Release()
+    }
+    return seq, n, err
 }
 
-func FetchRows(rows *sql.Rows, row []interface{}, columnTypes []*sql.ColumnType, doubleQuotes bool, coRows chan <- []string) {
-    for rows.Next() {
-        if err := rows.Scan(row...); err != nil {
-            fmt.Println(err)
-        }
-
-        strRow := make([]string, len(row))
+func (b *RawBatch) Release() {
+    b.Rows = 0
+    b.pool.Put(b)
+}
 
-        // Columns to string array
-        for i, col := range row {
-            typeName := columnTypes[i].DatabaseTypeName();
-            strRow[i] = ToString(col, typeName)
+// FormatRows formats batches of scanned rows into batches of lines
+func FormatRows(params Params, ciRaw <- chan *RawBatch, coRows chan <- *RowBatch) {
+    for raw := range ciRaw {
+        start := time.Now()
 
-            if doubleQuotes && (typeName == "VARCHAR2" || typeName == "NVARCHAR2" || typeName == "DATE" || typeName == "TIMESTAMP" || typeName == "TIMESTAMP WITH TIME ZONE" || typeName == "TIMESTAMP WITH LOCAL TIME ZONE") {
-                strRow[i] = "\"" + strings.ReplaceAll(strRow[i], "\"", "\"\"") + "\""
-            }
+        batch := NewRowBatch()
+        for i := 0; i < raw.Rows; i++ {
+            batch.Lines = params.Format.AppendRow(batch.Lines, raw.Formatters, raw.Values[i])
         }
+        batch.Rows = raw.Rows
+        batch.Seq = raw.Seq
+        raw.Release()
 
-        coRows <- strRow
+        params.Metrics.Format.Record(batch.Rows, len(batch.Lines), start)
+        params.Metrics.Write.Queue(len(coRows))
+        coRows <- batch
     }
 }
 
-func TrimExtension(fileName string) string {
-    extension := filepath.Ext(fileName)
-    name := fileName[0:len(fileName)-len(extension)]
-    return name
+func NewPipelineMetrics() *PipelineMetrics {
+    return &PipelineMetrics{Fetch: StageMetrics{Name: "fetch"}, Format: StageMetrics{Name: "format"},
+                            Write: StageMetrics{Name: "write"}, Compress: StageMetrics{Name: "compress"}}
 }
 
-func NewFile(fileName string, extension string, rId int, counter *int) (*os.File) {
-    *counter++;
+// Record adds a batch processed since start
+func (m *StageMetrics) Record(rows int, bytes int, start time.Time) {
+    atomic.AddInt64(&m.Rows, int64(rows))
+    atomic.AddInt64(&m.Bytes, int64(bytes))
+    atomic.AddInt64(&m.Batches, 1)
+    atomic.AddInt64(&m.Busy, int64(time.Since(start)))
+}
 
-    fn := fileName;
-    if rId == 0 {
-        fn += fmt.Sprintf("_%07d." + extension, *counter);
-    } else {
-        fn += fmt.Sprintf("_%d_%07d." + extension, rId, *counter)
-    }
+// Queue records the number of batches waiting in the input channel
+func (m *StageMetrics) Queue(n int) {
+    atomicMax(&m.MaxQueued, int64(n))
+}
 
-    f, err := os.Create(fn)
-    if err != nil {
-        fmt.Println("NewFile", err)
-        f.Close()
+// Hold records the bytes held by the stage
+func (m *StageMetrics) Hold(bytes int) {
+    atomicMax(&m.MaxHeld, int64(bytes))
+}
+
+func atomicMax(v *int64, n int64) {
+    for {
+        old := atomic.LoadInt64(v)
+        if n <= old || atomic.CompareAndSwapInt64(v, old, n) {
+            return
+        }
     }
-    return f
 }
 
-func CompressFile(fileName string) {
-    file, err := os.Open(fileName)
-    if err != nil {
-        fmt.Println(err)
-        return
+// PrintPipelineMetrics prints rows per second of busy time and memory use of every stage.
+// Queued MB is the maximum of batches in the input channel by the average batch size
+func PrintPipelineMetrics(m *PipelineMetrics) {
+    Log()
+    fmt.Fprintf(logOut, "%-10s %12s %10s %10s %12s %8s %10s %10s\n", "STAGE", "ROWS", "MB", "BUSY", "ROWS/SEC", "QUEUED", "QUEUED MB", "HELD MB")
+    for _, s := range []*StageMetrics{&m.Fetch, &m.Format, &m.Write, &m.Compress} {
+        if s.Batches == 0 {
+            continue
+        }
+        busy := time.Duration(s.Busy)
+        rate := 0.0
+        if busy > 0 {
+            rate = float64(s.Rows) / busy.Seconds()
+        }
+        queuedMB := float64(s.MaxQueued) * float64(s.Bytes) / float64(s.Batches) / 1024 / 1024
+        fmt.Fprintf(logOut, "%-10s %12d %10.1f %10s %12.0f %8d %10.1f %10.1f\n", s.Name, s.Rows, float64(s.Bytes) / 1024 / 1024,
+                    busy.Round(time.Millisecond), rate, s.MaxQueued, queuedMB, float64(s.MaxHeld) / 1024 / 1024)
     }
-    defer file.Close()
 
-    gz, err := os.Create(fileName + ".gz")
-    if err != nil {
-        fmt.Println(err)
-        return
+    var ms runtime.MemStats
+    runtime.ReadMemStats(&ms)
+    Log("... Memory: heap", ms.HeapInuse / 1024 / 1024, "MB, total allocated", ms.TotalAlloc / 1024 / 1024, "MB, from OS", ms.Sys / 1024 / 1024, "MB")
+}
+
+func NewProgress() *Progress {
+    return &Progress{start: time.Now(), workers: map[int]*WorkerProgress{}}
+}
+
+// Worker returns the counters of a connection, rId 0 is the connection of a query without ranges
+func (p *Progress) Worker(rId int) *WorkerProgress {
+    p.mu.Lock()
+    defer p.mu.Unlock()
+
+    w, ok := p.workers[rId]
+    if !ok {
+        w = &WorkerProgress{}
+        p.workers[rId] = w
     }
-    defer gz.Close()
+    return w
+}
 
-    w := gzip.NewWriter(gz)
-    defer w.Close()
+// AddRows counts rows written by a writer of the connection w, bytes are uncompressed
+func (p *Progress) AddRows(w *WorkerProgress, rows int, bytes int) {
+    atomic.AddInt64(&p.Rows, int64(rows))
+    atomic.AddInt64(&p.Bytes, int64(bytes))
+    atomic.AddInt64(&w.Rows, int64(rows))
+    atomic.AddInt64(&w.Bytes, int64(bytes))
+}
 
-    reader := bufio.NewReader(file)
-    buf := make([]byte, 1024)
+// RangeDone counts a range exported by a connection
+func (p *Progress) RangeDone(rId int, r Range, d time.Duration) {
+    w := p.Worker(rId)
+    atomic.AddInt64(&p.Ranges, 1)
+    atomic.AddInt64(&p.Keys, int64(r.LastValue - r.FirstValue + 1))
+    atomic.AddInt64(&w.Ranges, 1)
+    atomic.AddInt64(&w.QueryTime, int64(d))
+}
 
-    for {
-        n, err := reader.Read(buf)
+// Plan adds the keys of a range export and changes the planned number of ranges by delta
+func (p *Progress) Plan(keys int64, delta int64) {
+    atomic.AddInt64(&p.KeysTotal, keys)
+    atomic.AddInt64(&p.RangesTotal, delta)
+}
 
-        if err != nil {
-            if err != io.EOF {
-                fmt.Println(err)
-            }
-            break
-        }
+// Writer counts the bytes written to a file of the connection
+func (p *Progress) Writer(rId int, f io.Writer) io.Writer {
+    return &ProgressWriter{w: f, p: p, worker: p.Worker(rId)}
+}
 
-        w.Write(buf[0:n])
-    }
+func (pw *ProgressWriter) Write(b []byte) (int, error) {
+    n, err := pw.w.Write(b)
+    atomic.AddInt64(&pw.p.Written, int64(n))
+    atomic.AddInt64(&pw.worker.Written, int64(n))
+    return n, err
 }
 
-func CloseFile(f *os.File, compress bool) {
-    fileName := f.Name();
+// Line is the progress of the export, the ETA is based on the keys of the range plan
+func (p *Progress) Line() string {
+    elapsed := time.Since(p.start)
+    rows := atomic.LoadInt64(&p.Rows)
+    keys := atomic.LoadInt64(&p.Keys)
+    keysTotal := atomic.LoadInt64(&p.KeysTotal)
 
-    err := f.Close()
-    if err != nil {
-        fmt.Println("CloseFile", err)
+    s := fmt.Sprintf("rows %d, %.1f MB, written %.1f MB", rows, float64(atomic.LoadInt64(&p.Bytes)) / 1024 / 1024,
+                     float64(atomic.LoadInt64(&p.Written)) / 1024 / 1024)
+    if rangesTotal := atomic.LoadInt64(&p.RangesTotal); rangesTotal > 0 {
+        s += fmt.Sprintf(", ranges %d/%d", atomic.LoadInt64(&p.Ranges), rangesTotal)
+    }
+    if elapsed > 0 {
+        s += fmt.Sprintf(", %.0f rows/s", float64(rows) / elapsed.Seconds())
     }
+    if keys > 0 && keysTotal > keys {
+        eta := time.Duration(float64(elapsed) * float64(keysTotal - keys) / float64(keys))
+        s += ", ETA " + eta.Round(time.Second).String()
+    }
+    return s
+}
 
-    if !compress {
-        return
+// Bar is the line with a bar of the done keys of the range plan
+func (p *Progress) Bar() string {
+    keysTotal := atomic.LoadInt64(&p.KeysTotal)
+    if keysTotal == 0 {
+        return p.Line()
     }
 
-    CompressFile(fileName)
+    done := float64(atomic.LoadInt64(&p.Keys)) / float64(keysTotal)
+    n := int(done * 30)
+    return fmt.Sprintf("[%s%s] %3.0f%% %s", strings.Repeat("#", n), strings.Repeat(".", 30 - n), done * 100, p.Line())
+}
 
-    err = os.Remove(fileName) 
-    if err != nil { 
-        fmt.Println("CloseFile", err)
+// Start reports the progress every interval, as a bar redrawn in place or as log lines
+func (p *Progress) Start(mode string, interval time.Duration) {
+    if mode == "auto" {
+        mode = "log"
+        if IsTerminal(logOut) {
+            mode = "bar"
+        }
+    }
+    if mode == "bar" {
+        atomic.StoreInt32(&progressBar, 1)
+        interval = time.Second
     }
+    p.mode = mode
+
+    p.done = make(chan struct{})
+    p.stopped.Add(1)
+    go func() {
+        defer p.stopped.Done()
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+
+        for {
+            select {
+            case <- p.done:
+                return
+            case <- ticker.C:
+                p.Print()
+            }
+        }
+    }()
 }
 
-func GetSizeMB(f *os.File) float64 {
-    fi, err := f.Stat()
-    if err != nil {
-        fmt.Println("GetSizeMB", err)
+func (p *Progress) Print() {
+    if p.mode == "bar" {
+        fmt.Fprint(logOut, "\r\033[K" + p.Bar())
+    } else {
+        Log("...", p.Line())
     }
-    return float64(fi.Size()) / 1024 / 1024
 }
 
-func WriteToFile(rId int, params Params, maxSizeMB int, ciRows <- chan []string) {
-	counter := 0;
+// Stop prints the last progress and the summary per connection
+func (p *Progress) Stop() {
+    close(p.done)
+    p.stopped.Wait()
 
-	sep := ",";
-    extension := "csv";
-    if params.TabSeparated {
-    	sep = "\t"
-    	extension = "tsv"
+    p.Print()
+    if p.mode == "bar" {
+        fmt.Fprintln(logOut)
+        atomic.StoreInt32(&progressBar, 0)
     }
+    p.PrintSummary()
+}
 
-    f := NewFile(params.FileName, extension, rId, &counter)
+// PrintSummary prints the ranges, rows, megabytes and query time of every connection,
+// rows per second are rows by the elapsed time of the export
+func (p *Progress) PrintSummary() {
+    p.mu.Lock()
+    defer p.mu.Unlock()
 
-    i := 0;
-    for row := range ciRows {
-    	// Check file size one time per N rows
-        i++;
-        if i >= 1000 {
-            i = 0;
-            compressionRatio := 1.0;
-            if params.Compress {
-                compressionRatio = 0.11;
-            }
-            if float64(maxSizeMB) * float64(0.95) <= GetSizeMB(f) * compressionRatio {
-                CloseFile(f, params.Compress)
-                f = NewFile(params.FileName, extension, rId, &counter)
-            }
-        }
+    ids := []int{}
+    for rId := range p.workers {
+        ids = append(ids, rId)
+    }
+    sort.Ints(ids)
 
-        fmt.Fprintln(f, strings.Join(row, sep))
+    elapsed := time.Since(p.start)
+    Log()
+    fmt.Fprintf(logOut, "%-8s %8s %12s %10s %12s %12s %12s\n", "WORKER", "RANGES", "ROWS", "MB", "WRITTEN MB", "QUERY TIME", "ROWS/SEC")
+    for _, rId := range ids {
+        w := p.workers[rId]
+        fmt.Fprintf(logOut, "%-8d %8d %12d %10.1f %12.1f %12s %12.0f\n", rId, w.Ranges, w.Rows, float64(w.Bytes) / 1024 / 1024,
+                    float64(w.Written) / 1024 / 1024, time.Duration(w.QueryTime).Round(time.Millisecond), float64(w.Rows) / elapsed.Seconds())
     }
+    Log("... Elapsed", elapsed.Round(time.Millisecond))
+}
 
-    CloseFile(f, params.Compress)
-}
\ No newline at end of file
+// IsTerminal reports if the writer is a terminal
+func IsTerminal(w io.Writer) bool {
+    f, ok := w.(*os.File)
+    if !ok {
+        return false
+    }
+    fi, err := f.Stat()
+    return err == nil && fi.Mode() & os.ModeCharDevice != 0
+}
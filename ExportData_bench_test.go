@@ -0,0 +1,225 @@
+package main
+
+import (
+    "bufio"
+    "database/sql"
+    "fmt"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+// Rows of the benchmarks: number, text, text with separator and quote, date, NULL, CLOB
+const benchRows = 10000
+
+func benchFormat(b *testing.B) Format {
+    f, err := NewFormat(Params{}, ",", "\"", "double", "", "minimal", "LF")
+    if err != nil {
+        b.Fatal(err)
+    }
+    // Columns of the benchmarks have no database type
+    f.TimeLayouts = map[string]string{"": "2006-01-02 15:04:05"}
+    return f
+}
+
+func benchScanRows() [][]interface{} {
+    rows := make([][]interface{}, benchRows)
+    for i := range rows {
+        rows[i] = []interface{}{
+            &sql.NullString{String: fmt.Sprintf("%d.%02d", i * 37, i % 100), Valid: true},
+            &sql.NullString{String: "plain text value", Valid: true},
+            &sql.NullString{String: "Smith, \"John\"", Valid: true},
+            &sql.NullTime{Time: time.Date(2024, 1, 31, 12, 30, i % 60, 0, time.UTC), Valid: true},
+            &sql.NullString{},
+            &LobString{NullString: sql.NullString{String: strings.Repeat("clob ", 40), Valid: true}},
+        }
+    }
+    return rows
+}
+
+func devNull(b *testing.B) *os.File {
+    f, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+    if err != nil {
+        b.Fatal(err)
+    }
+    return f
+}
+
+// Row path before per-column formatters: a []string per row, type dispatch with
+// fmt.Sprintf("%T"), strings.Join and one unbuffered write per row
+func legacyToString(i interface{}, columnType string, format Format) string {
+    switch fmt.Sprintf("%T", i) {
+    case "*sql.NullString":
+        v := *i.(*sql.NullString)
+        if !v.Valid {
+            return ""
+        }
+        return v.String
+    case "*sql.NullTime":
+        return NullTimeToString(*i.(*sql.NullTime), columnType, format)
+    case "*main.LobString":
+        v := i.(*LobString).NullString
+        if !v.Valid {
+            return ""
+        }
+        return v.String
+    }
+    return ""
+}
+
+func legacyIsNull(i interface{}) bool {
+    switch v := i.(type) {
+    case *sql.NullString:
+        return !v.Valid
+    case *sql.NullTime:
+        return !v.Valid
+    case *LobString:
+        return !v.Valid
+    }
+    return true
+}
+
+func legacyField(f Format, s string, typeName string) string {
+    quote := f.Quoting == "all" || (f.Quoting == "text" && typeName != "NUMBER")
+    if !quote && !f.NeedsQuote(s) {
+        return s
+    }
+    return f.Quote + strings.ReplaceAll(s, f.Quote, f.Quote + f.Quote) + f.Quote
+}
+
+func BenchmarkRowsLegacy(b *testing.B) {
+    format := benchFormat(b)
+    rows := benchScanRows()
+    out := devNull(b)
+    defer out.Close()
+    enc := NewEncoder(Params{Encoding: "utf-8"})
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        cRows := make(chan []string, 100)
+        done := make(chan struct{})
+
+        go func() {
+            for row := range cRows {
+                line, _ := enc.Encode([]byte(strings.Join(row, format.Sep)))
+                fmt.Fprintln(out, string(line))
+            }
+            close(done)
+        }()
+
+        for _, row := range rows {
+            strRow := make([]string, len(row))
+            for i, col := range row {
+                if legacyIsNull(col) {
+                    strRow[i] = format.Null
+                    continue
+                }
+                strRow[i] = legacyField(format, legacyToString(col, "", format), "")
+            }
+            cRows <- strRow
+        }
+        close(cRows)
+        <-done
+    }
+    b.SetBytes(int64(benchBytes(format, rows)))
+}
+
+// Row path of FetchRows and WriteToFile: per-column formatters append to batches,
+// batches are encoded and written through a bufio.Writer
+func BenchmarkRowsBatched(b *testing.B) {
+    format := benchFormat(b)
+    rows := benchScanRows()
+    formatters := benchFormatters(format, rows[0])
+    out := devNull(b)
+    defer out.Close()
+    enc := NewEncoder(Params{Encoding: "utf-8"})
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        cRows := make(chan *RowBatch, 4)
+        done := make(chan struct{})
+
+        go func() {
+            w := bufio.NewWriterSize(out, 1024 * 1024)
+            for batch := range cRows {
+                enc.EncodeBatch(batch)
+                w.Write(batch.Lines)
+                batch.Release()
+            }
+            w.Flush()
+            close(done)
+        }()
+
+        batch := NewRowBatch()
+        for _, row := range rows {
+            batch.Lines = format.AppendRow(batch.Lines, formatters, row)
+            batch.Rows++
+            if batch.Rows >= BatchRows || len(batch.Lines) >= BatchBytes {
+                cRows <- batch
+                batch = NewRowBatch()
+            }
+        }
+        cRows <- batch
+        close(cRows)
+        <-done
+    }
+    b.SetBytes(int64(benchBytes(format, rows)))
+}
+
+// Formatting only, without channel and writes
+func BenchmarkAppendRow(b *testing.B) {
+    format := benchFormat(b)
+    rows := benchScanRows()
+    formatters := benchFormatters(format, rows[0])
+    buf := make([]byte, 0, BatchBytes)
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        row := rows[n % len(rows)]
+        buf = format.AppendRow(buf[:0], formatters, row)
+    }
+}
+
+func BenchmarkLegacyLine(b *testing.B) {
+    format := benchFormat(b)
+    rows := benchScanRows()
+
+    b.ReportAllocs()
+    b.ResetTimer()
+    for n := 0; n < b.N; n++ {
+        row := rows[n % len(rows)]
+        strRow := make([]string, len(row))
+        for i, col := range row {
+            if legacyIsNull(col) {
+                strRow[i] = format.Null
+                continue
+            }
+            strRow[i] = legacyField(format, legacyToString(col, "", format), "")
+        }
+        _ = strings.Join(strRow, format.Sep) + format.LineEnd
+    }
+}
+
+func benchFormatters(format Format, row []interface{}) []Formatter {
+    formatters := make([]Formatter, len(row))
+    for i, value := range row {
+        formatters[i] = format.NewFormatter(&sql.ColumnType{}, value, nil)
+    }
+    return formatters
+}
+
+// Size of the rows as text, the same for both paths
+func benchBytes(format Format, rows [][]interface{}) int {
+    formatters := benchFormatters(format, rows[0])
+    size := 0
+    var buf []byte
+    for _, row := range rows {
+        buf = format.AppendRow(buf[:0], formatters, row)
+        size += len(buf)
+    }
+    return size
+}
@@ -0,0 +1,1298 @@
+package main
+
+import (
+    "bufio"
+    "bytes"
+    "database/sql"
+    "database/sql/driver"
+    "encoding/csv"
+    "errors"
+    "flag"
+    "io"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+    "unicode"
+)
+
+// Rows written with AppendRow are read back with encoding/csv
+func TestAppendRowCSVRoundTrip(t *testing.T) {
+    clob := strings.Repeat("CLOB \"value\", line\r\nnext;\t", 2000)
+    values := [][]string{
+        {"plain", "1", "", "x"},
+        {"a,b", "a;b", "a\tb", "end,"},
+        {"say \"hi\"", "\"", "\"\"", "q\"q\"q"},
+        {"line\nbreak", "carriage\rreturn", "windows\r\nbreak", "\n"},
+        {clob, "Москва", "tail\r\n", "\r"},
+    }
+
+    for _, tc := range []struct {
+        name      string
+        delimiter string
+        quoting   string
+        lineEnd   string
+    }{
+        {"comma minimal LF", ",", "minimal", "LF"},
+        {"comma minimal CRLF", ",", "minimal", "CRLF"},
+        {"comma all LF", ",", "all", "LF"},
+        {"comma all CRLF", ",", "all", "CRLF"},
+        {"semicolon minimal", ";", "minimal", "LF"},
+        {"tab all", "\\t", "all", "CRLF"},
+    } {
+        t.Run(tc.name, func(t *testing.T) {
+            f, err := NewFormat(Params{}, tc.delimiter, "\"", "double", "NULL", tc.quoting, tc.lineEnd)
+            if err != nil {
+                t.Fatal(err)
+            }
+
+            // The last column is read as a CLOB
+            row := []interface{}{&sql.NullString{}, &sql.NullString{}, &sql.NullString{}, &LobString{}}
+            formatters := make([]Formatter, len(row))
+            for i, value := range row {
+                formatters[i] = f.NewFormatter(&sql.ColumnType{}, value, nil)
+            }
+
+            var buf []byte
+            for _, r := range values {
+                for i, v := range r {
+                    switch value := row[i].(type) {
+                    case *sql.NullString:
+                        *value = sql.NullString{String: v, Valid: true}
+                    case *LobString:
+                        value.NullString = sql.NullString{String: v, Valid: true}
+                    }
+                }
+                buf = f.AppendRow(buf, formatters, row)
+            }
+
+            if !bytes.HasSuffix(buf, []byte(f.LineEnd)) {
+                t.Fatalf("line end %q missing", f.LineEnd)
+            }
+            if tc.lineEnd == "LF" && bytes.HasSuffix(buf, []byte("\r\n")) {
+                t.Fatalf("CRLF written with LF line end")
+            }
+
+            r := csv.NewReader(bytes.NewReader(buf))
+            r.Comma = []rune(f.Sep)[0]
+            for i, want := range values {
+                got, err := r.Read()
+                if err != nil {
+                    t.Fatalf("row %d: %v", i, err)
+                }
+                if len(got) != len(want) {
+                    t.Fatalf("row %d: %d fields, want %d", i, len(got), len(want))
+                }
+                for j := range want {
+                    // encoding/csv reads CRLF inside quoted fields as LF
+                    w := strings.ReplaceAll(want[j], "\r\n", "\n")
+                    if got[j] != w {
+                        t.Errorf("row %d field %d: got %.40q, want %.40q", i, j, got[j], w)
+                    }
+                }
+            }
+            if _, err := r.Read(); err != io.EOF {
+                t.Fatalf("extra rows: %v", err)
+            }
+        })
+    }
+}
+
+func TestAppendRowNull(t *testing.T) {
+    f, err := NewFormat(Params{}, ",", "\"", "double", "NULL", "all", "LF")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    row := []interface{}{&sql.NullString{}, &sql.NullString{String: "NULL", Valid: true}, &LobString{}}
+    formatters := make([]Formatter, len(row))
+    for i, value := range row {
+        formatters[i] = f.NewFormatter(&sql.ColumnType{}, value, nil)
+    }
+
+    // NULL is unquoted, the text NULL is quoted
+    if got := string(f.AppendRow(nil, formatters, row)); got != "NULL,\"NULL\",NULL\n" {
+        t.Errorf("got %q", got)
+    }
+}
+
+// A NUMBER(38) value
+const max38 = "12345678901234567890123456789012345678"
+
+func TestDecimal(t *testing.T) {
+    for _, tc := range []struct {
+        in          string
+        plain       string
+        scientific  string
+    }{
+        {max38, max38, "1.2345678901234567890123456789012345678E+37"},
+        {"-" + max38, "-" + max38, "-1.2345678901234567890123456789012345678E+37"},
+        {"0." + max38, "0." + max38, "1.2345678901234567890123456789012345678E-01"},
+        {"-.00000000000000000000000000000000000001", "-0.00000000000000000000000000000000000001", "-1E-38"},
+        {"1E+125", "1" + strings.Repeat("0", 125), "1E+125"},
+        {"100", "100", "1E+02"},
+        {"1", "1", "1E+00"},
+        {"1.50", "1.5", "1.5E+00"},
+        {"+007.0", "7", "7E+00"},
+        {"-0", "0", "0E+00"},
+        {".5", "0.5", "5E-01"},
+        {"1.5e-3", "0.0015", "1.5E-03"},
+    } {
+        d, ok := ParseDecimal(tc.in)
+        if !ok {
+            t.Errorf("ParseDecimal(%q) failed", tc.in)
+            continue
+        }
+        if got := d.Plain("."); got != tc.plain {
+            t.Errorf("Plain(%q) = %q, want %q", tc.in, got, tc.plain)
+        }
+        if got := d.Scientific("."); got != tc.scientific {
+            t.Errorf("Scientific(%q) = %q, want %q", tc.in, got, tc.scientific)
+        }
+    }
+
+    for _, in := range []string{"", "-", "abc", "1.2.3", "1e", "1,5", "--1"} {
+        if _, ok := ParseDecimal(in); ok {
+            t.Errorf("ParseDecimal(%q) accepted", in)
+        }
+    }
+}
+
+func TestDecimalRound(t *testing.T) {
+    for _, tc := range []struct {
+        in      string
+        scale   int
+        fixed   string
+    }{
+        {"1.50", 2, "1.50"},
+        {"1.5", 0, "2"},
+        {"-1.5", 0, "-2"},
+        {"0.005", 2, "0.01"},
+        {"-0.004", 2, "0.00"},
+        {"9.999", 2, "10.00"},
+        {"100", 3, "100.000"},
+        {"1E+2", 1, "100.0"},
+        {max38, 0, max38},
+        {"1234567890123456789012345678901234567.85", 1, "1234567890123456789012345678901234567.9"},
+        {"0.12345678901234567890123456789012345678", 38, "0.12345678901234567890123456789012345678"},
+    } {
+        d, _ := ParseDecimal(tc.in)
+        if got := d.Fixed(tc.scale, "."); got != tc.fixed {
+            t.Errorf("Fixed(%q, %d) = %q, want %q", tc.in, tc.scale, got, tc.fixed)
+        }
+    }
+
+    // Negative scale of NUMBER(p,-s) rounds to tens, hundreds, ...
+    for _, tc := range []struct {
+        in      string
+        scale   int
+        plain   string
+    }{
+        {"12351", -2, "12400"},
+        {"12349", -2, "12300"},
+        {"-12351", -2, "-12400"},
+        {"49", -2, "0"},
+        {"50", -2, "100"},
+        {"999", -1, "1000"},
+        {"49", -3, "0"},
+    } {
+        d, _ := ParseDecimal(tc.in)
+        if got := d.Round(tc.scale).Plain("."); got != tc.plain {
+            t.Errorf("Round(%q, %d) = %q, want %q", tc.in, tc.scale, got, tc.plain)
+        }
+    }
+}
+
+func TestDecimalSeparator(t *testing.T) {
+    d, _ := ParseDecimal("-123.45")
+    if got := d.Plain(","); got != "-123,45" {
+        t.Errorf("Plain = %q", got)
+    }
+    if got := d.Fixed(3, ","); got != "-123,450" {
+        t.Errorf("Fixed = %q", got)
+    }
+    if got := d.Scientific(","); got != "-1,2345E+02" {
+        t.Errorf("Scientific = %q", got)
+    }
+
+    // Integers have no separator
+    d, _ = ParseDecimal("100")
+    if got := d.Plain(","); got != "100" {
+        t.Errorf("Plain = %q", got)
+    }
+}
+
+// The Oracle text of a NUMBER is rendered like NormalizeNumber of SnowflakeChecksum
+// renders the Snowflake text of the same value (see SnowflakeChecksum_test.go)
+func TestDecimalMatchesSnowflake(t *testing.T) {
+    for oracle, want := range map[string]string{
+        "100": "100", "1": "1", "1.5": "1.5", "-.25": "-0.25", "0": "0", ".1": "0.1",
+        max38: max38, "-1.23": "-1.23",
+    } {
+        d, _ := ParseDecimal(oracle)
+        if got := d.Plain("."); got != want {
+            t.Errorf("Plain(%q) = %q, want %q", oracle, got, want)
+        }
+    }
+}
+
+func TestTokenize(t *testing.T) {
+    salt := []byte("salt")
+
+    for _, value := range []string{"Иванов Пётр", "John Smith", "Ελένη", "Ærø Ūnė", "+7 (495) 123-45-67"} {
+        token := Tokenize(value, salt)
+        if token != Tokenize(value, salt) {
+            t.Errorf("Tokenize(%q) is not deterministic", value)
+        }
+        if value != "" && token == value {
+            t.Errorf("Tokenize(%q) kept the value", value)
+        }
+
+        runes, tokens := []rune(value), []rune(token)
+        if len(runes) != len(tokens) {
+            t.Fatalf("Tokenize(%q) = %q, length changed", value, token)
+        }
+        for i, r := range runes {
+            tr := tokens[i]
+            switch {
+            case unicode.IsLetter(r):
+                if !unicode.IsLetter(tr) || unicode.IsUpper(r) != unicode.IsUpper(tr) ||
+                    unicode.Is(unicode.Cyrillic, r) != unicode.Is(unicode.Cyrillic, tr) ||
+                    unicode.Is(unicode.Latin, r) != unicode.Is(unicode.Latin, tr) ||
+                    unicode.Is(unicode.Greek, r) != unicode.Is(unicode.Greek, tr) {
+                    t.Errorf("Tokenize(%q): %q replaced with %q", value, r, tr)
+                }
+            case unicode.IsDigit(r):
+                if !unicode.IsDigit(tr) {
+                    t.Errorf("Tokenize(%q): %q replaced with %q", value, r, tr)
+                }
+            default:
+                if r != tr {
+                    t.Errorf("Tokenize(%q): %q replaced with %q", value, r, tr)
+                }
+            }
+        }
+    }
+}
+
+func TestCheckMaskSalt(t *testing.T) {
+    masks, err := ParseMasks([]string{"NOTE=redact", "PHONE=token"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if CheckMaskSalt(masks, nil) == nil {
+        t.Error("token mask without salt accepted")
+    }
+    if err := CheckMaskSalt(masks, []byte("salt")); err != nil {
+        t.Error(err)
+    }
+    if err := CheckMaskSalt(map[string]Mask{"NOTE": {Kind: "truncate", Arg: "3"}}, nil); err != nil {
+        t.Error(err)
+    }
+}
+
+func TestConnStr(t *testing.T) {
+    for _, tc := range []struct {
+        connStr     string
+        user        string
+        password    string
+        dsn         string
+        rebuilt     string
+    }{
+        {"scott/tiger@db:1521/orcl", "scott", "tiger", "db:1521/orcl", "scott/tiger@db:1521/orcl"},
+        {"scott/p@ss/w@db/orcl", "scott", "p@ss/w", "db/orcl", "scott/\"p@ss/w\"@db/orcl"},
+        {"scott/\"p@ss\"@db", "scott", "p@ss", "db", "scott/\"p@ss\"@db"},
+        {"scott/tiger", "scott", "tiger", "", "scott/tiger"},
+        {"scott", "scott", "", "", "scott/"},
+        {"scott@db", "scott", "", "db", "scott/@db"},
+    } {
+        user, password, dsn, _ := ParseConnStr(tc.connStr)
+        if user != tc.user || password != tc.password || dsn != tc.dsn {
+            t.Errorf("ParseConnStr(%q) = %q, %q, %q", tc.connStr, user, password, dsn)
+        }
+        if got := BuildConnStr(user, password, dsn); got != tc.rebuilt {
+            t.Errorf("BuildConnStr(%q) = %q, want %q", tc.connStr, got, tc.rebuilt)
+        }
+    }
+}
+
+// secretPlugin writes a fake exec plugin: it prints the secret of known names,
+// fails on "broken" and prints nothing for "empty"
+func secretPlugin(t *testing.T) string {
+    script := filepath.Join(t.TempDir(), "secret.sh")
+    content := `#!/bin/sh
+case "$2" in
+    oracle/prod) echo 'p@ss/w rd' ;;
+    oracle/user) printf 'scott\r\n' ;;
+    broken) echo "no access" >&2; exit 3 ;;
+    empty) ;;
+esac
+`
+    if err := ioutil.WriteFile(script, []byte(content), 0700); err != nil {
+        t.Fatal(err)
+    }
+    return script
+}
+
+func TestExecProvider(t *testing.T) {
+    script := secretPlugin(t)
+    p := &ExecProvider{Command: "/bin/sh " + script + " --"}
+
+    if secret, err := p.Secret("oracle/prod"); err != nil || secret != "p@ss/w rd" {
+        t.Errorf("Secret = %q, %v", secret, err)
+    }
+    if secret, err := p.Secret("oracle/user"); err != nil || secret != "scott" {
+        t.Errorf("Secret = %q, %v", secret, err)
+    }
+    if _, err := p.Secret("broken"); err == nil || !strings.Contains(err.Error(), "exit status 3") {
+        t.Errorf("failing plugin: %v", err)
+    }
+    if _, err := p.Secret("empty"); err == nil || !strings.Contains(err.Error(), "printed nothing") {
+        t.Errorf("empty secret: %v", err)
+    }
+    if _, err := (&ExecProvider{Command: " "}).Secret("oracle/prod"); err == nil {
+        t.Error("empty command accepted")
+    }
+    if _, err := (&ExecProvider{Command: filepath.Join(t.TempDir(), "missing")}).Secret("oracle/prod"); err == nil {
+        t.Error("missing command accepted")
+    }
+}
+
+func TestResolveConnSecrets(t *testing.T) {
+    Secrets = &ExecProvider{Command: "/bin/sh " + secretPlugin(t) + " --"}
+    defer func() {
+        Secrets = nil
+        secretCache = map[string]string{}
+    }()
+
+    for _, tc := range []struct {
+        connStr     string
+        want        string
+    }{
+        {"scott/${secret:oracle/prod}@db:1521/orcl", "scott/\"p@ss/w rd\"@db:1521/orcl"},
+        {"${secret:oracle/user}/${secret:oracle/prod}@db", "scott/\"p@ss/w rd\"@db"},
+        {"scott/\"${secret:oracle/prod}\"@db", "scott/\"p@ss/w rd\"@db"},
+        {"scott/tiger@db", "scott/tiger@db"},
+        {"${secret:oracle/user}@db", "scott@db"},
+    } {
+        got, err := ResolveConnSecrets(tc.connStr)
+        if err != nil || got != tc.want {
+            t.Errorf("ResolveConnSecrets(%q) = %q, %v, want %q", tc.connStr, got, err, tc.want)
+        }
+    }
+
+    if _, err := ResolveConnSecrets("scott/${secret:broken}@db"); err == nil {
+        t.Error("failing secret resolved")
+    }
+
+    // Resolved secrets are cached
+    Secrets = &ExecProvider{Command: "/bin/false"}
+    if got, err := ResolveConnSecrets("scott/${secret:oracle/prod}@db"); err != nil || got != "scott/\"p@ss/w rd\"@db" {
+        t.Errorf("cached secret: %q, %v", got, err)
+    }
+}
+
+// A file that can't be created fails the export instead of writing to a nil file
+func TestWriteToFileMissingDirectory(t *testing.T) {
+    params := Params{FileName: filepath.Join(t.TempDir(), "missing", "out"), Encoding: "utf-8", PipelineBuffer: 1,
+                     Manifest: &Manifest{}, Metrics: NewPipelineMetrics(), Progress: NewProgress()}
+
+    cRows := make(chan *RowBatch, 1)
+    batch := NewRowBatch()
+    batch.Lines = append(batch.Lines, "1\n"...)
+    batch.Rows = 1
+    cRows <- batch
+    close(cRows)
+
+    WriteToFile(0, 0, params, 100, cRows)
+    if params.Manifest.Err() == nil || len(params.Manifest.Files) > 0 {
+        t.Errorf("export did not fail: %v, %v", params.Manifest.Err(), params.Manifest.Files)
+    }
+}
+
+func TestWriteToStreamOrdered(t *testing.T) {
+    f, err := os.Create(filepath.Join(t.TempDir(), "out.csv"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    s := &Stream{f: f, w: bufio.NewWriter(f)}
+    params := Params{Encoding: "utf-8", FormatWorkers: 2, Ordered: true, Stream: s,
+                     Manifest: &Manifest{}, Metrics: NewPipelineMetrics(), Progress: NewProgress()}
+
+    cRows := make(chan *RowBatch, 3)
+    for _, seq := range []int{2, 0, 1} {
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, strconv.Itoa(seq) + "\n"...)
+        batch.Rows = 1
+        batch.Seq = seq
+        cRows <- batch
+    }
+    close(cRows)
+
+    WriteToFile(0, 0, params, 100, cRows)
+    s.Close()
+
+    content, err := ioutil.ReadFile(f.Name())
+    if err != nil {
+        t.Fatal(err)
+    }
+    if string(content) != "0\n1\n2\n" {
+        t.Errorf("stream = %q, want %q", content, "0\n1\n2\n")
+    }
+}
+
+func TestRangeSizer(t *testing.T) {
+    type step struct {
+        width   int
+        res     RangeResult
+        want    int
+    }
+    result := func(first int, last int, rows int, duration time.Duration) RangeResult {
+        return RangeResult{Range: Range{FirstValue: first, LastValue: last}, Rows: rows, Duration: duration}
+    }
+    timeout := func(first int, last int) RangeResult {
+        return RangeResult{Range: Range{FirstValue: first, LastValue: last}, Timeout: true}
+    }
+
+    tests := []struct {
+        name    string
+        sizer   RangeSizer
+        steps   []step
+    }{
+        {"growth at most 4 times", RangeSizer{TargetRows: 1000},
+            []step{{100, result(1, 100, 100, 0), 400}, {400, result(101, 500, 400, 0), 1000}}},
+        {"shrink to target rows", RangeSizer{TargetRows: 1000},
+            []step{{1000, result(1, 1000, 10000, 0), 100}}},
+        {"shrink to target time", RangeSizer{TargetTime: time.Second},
+            []step{{1000, result(1, 1000, 10, 10 * time.Second), 100}}},
+        {"smaller of both targets", RangeSizer{TargetRows: 1000, TargetTime: time.Second},
+            []step{{1000, result(1, 1000, 2000, 10 * time.Second), 100}}},
+        {"moving average", RangeSizer{TargetRows: 1000},
+            []step{{1000, result(1, 1000, 1000, 0), 1000}, {1000, result(1001, 2000, 3000, 0), 500},
+                   {500, result(2001, 2500, 500, 0), 666}}},
+        {"clamp to max width", RangeSizer{TargetRows: 1000, MaxWidth: 200},
+            []step{{100, result(1, 100, 100, 0), 200}}},
+        {"clamp to min width", RangeSizer{TargetRows: 1000, MinWidth: 500},
+            []step{{1000, result(1, 1000, 10000, 0), 500}}},
+        {"no targets", RangeSizer{},
+            []step{{1000, result(1, 1000, 10000, time.Hour), 1000}}},
+        {"timeout halves the range", RangeSizer{TargetRows: 1000},
+            []step{{1000, timeout(1, 1000), 500}, {500, timeout(1001, 1500), 250}}},
+        {"timeout keeps a smaller width", RangeSizer{},
+            []step{{100, timeout(1, 1000), 100}}},
+        {"timeout clamped to min width", RangeSizer{MinWidth: 600},
+            []step{{1000, timeout(1, 1000), 600}}},
+        {"timeout of one key", RangeSizer{},
+            []step{{1, timeout(5, 5), 1}}},
+    }
+
+    for _, tt := range tests {
+        s := tt.sizer
+        for i, st := range tt.steps {
+            if got := s.Next(st.width, st.res); got != st.want {
+                t.Errorf("%s, step %d: Next(%d) = %d, want %d", tt.name, i, st.width, got, st.want)
+            }
+        }
+    }
+}
+
+func TestSplitStatements(t *testing.T) {
+    tests := []struct {
+        name    string
+        text    string
+        want    []string
+    }{
+        {"statements", "select 1 from dual;\nselect 2\n  from dual;\n", []string{"select 1 from dual", "select 2\n  from dual"}},
+        {"last without ;", "commit;\nselect 1 from dual", []string{"commit", "select 1 from dual"}},
+        {"/ terminator", "select 1 from dual\n/\nselect 2 from dual\n/\n", []string{"select 1 from dual", "select 2 from dual"}},
+        {"plsql block", "begin\n  dbms_output.put_line('a');\nend;\n/\ncommit;", []string{"begin\n  dbms_output.put_line('a');\nend;", "commit"}},
+        {"declare block", "declare\n  n number;\nbegin\n  n := 1;\nend;\n/", []string{"declare\n  n number;\nbegin\n  n := 1;\nend;"}},
+        {"create procedure", "create or replace procedure p is\nbegin\n  null;\nend;\n/", []string{"create or replace procedure p is\nbegin\n  null;\nend;"}},
+        {"quoted ;", "select 'a;' from dual;\nselect \"A;\" from t;", []string{"select 'a;' from dual", "select \"A;\" from t"}},
+        {"quoted ; at end of line", "insert into t values ('a;\nb');\ncommit;", []string{"insert into t values ('a;\nb')", "commit"}},
+        {"doubled quote", "select 'it''s;' from dual;", []string{"select 'it''s;' from dual"}},
+        {"trailing comment", "select 1 from dual; -- note\nselect 2 from dual;", []string{"select 1 from dual", "select 2 from dual"}},
+        {"comment with ;", "select 1 -- note;\n  from dual;", []string{"select 1 -- note;\n  from dual"}},
+        {"-- in a literal", "select '--' from dual;\ncommit;", []string{"select '--' from dual", "commit"}},
+        {"comment lines", "-- first\n\nselect 1 from dual;\n-- last\n", []string{"select 1 from dual"}},
+        {"CRLF", "select 1 from dual;\r\ncommit;\r\n", []string{"select 1 from dual", "commit"}},
+        {"empty", "\n-- nothing\n", []string{}},
+    }
+
+    for _, tt := range tests {
+        if got := SplitStatements(tt.text); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: SplitStatements(%q) = %q, want %q", tt.name, tt.text, got, tt.want)
+        }
+    }
+}
+
+func TestParseQueryFile(t *testing.T) {
+    tests := []struct {
+        name    string
+        text    string
+        want    QueryFile
+        err     bool
+    }{
+        {"no sections", "select * from car\n", QueryFile{Query: "select * from car\n"}, false},
+        {"sections", "-- @session\nalter session set nls_date_format = 'YYYY-MM-DD';\n" +
+                     "begin\n  dbms_application_info.set_module('ExportData', 'car');\nend;\n/\n" +
+                     "-- @pre\nbegin dbms_mview.refresh('CAR_MV'); end;\n/\n" +
+                     "-- @query\nselect * from car_mv -- all rows\n" +
+                     "-- @post\ninsert into export_audit values ('car', :row_count); -- audit\ncommit;\n",
+            QueryFile{Session: []string{"alter session set nls_date_format = 'YYYY-MM-DD'",
+                                        "begin\n  dbms_application_info.set_module('ExportData', 'car');\nend;"},
+                      Pre: []string{"begin dbms_mview.refresh('CAR_MV'); end;"},
+                      Query: "select * from car_mv -- all rows",
+                      Post: []string{"insert into export_audit values ('car', :row_count)", "commit"}}, false},
+        {"query with ;", "-- @QUERY\nselect * from car;\n", QueryFile{Session: []string{}, Pre: []string{}, Query: "select * from car", Post: []string{}}, false},
+        {"statements before the first section", "commit;\n-- @query\nselect * from car", QueryFile{}, true},
+        {"two queries", "-- @query\nselect 1 from dual;\nselect 2 from dual;", QueryFile{}, true},
+        {"no query", "-- @pre\ncommit;", QueryFile{}, true},
+    }
+
+    for _, tt := range tests {
+        got, err := ParseQueryFile(tt.text)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: ParseQueryFile = %#v, want %#v", tt.name, got, tt.want)
+        }
+    }
+}
+
+// Driver of rows in memory, Next returns err after the values
+type memDriver struct{}
+type memConn struct{ values [][]driver.Value; err error; query string; columns []memColumn }
+type memStmt struct{ conn *memConn }
+type memRows struct{ values [][]driver.Value; err error; columns []memColumn }
+
+// Column of the mem driver, rows without columns have the column A
+type memColumn struct {
+    name        string
+    typeName    string
+    precision   int64
+    scale       int64
+    length      int64
+}
+
+var memQueries = map[string]*memConn{}
+
+func (memDriver) Open(name string) (driver.Conn, error) { return memQueries[name], nil }
+func (c *memConn) Prepare(query string) (driver.Stmt, error) { c.query = query; return &memStmt{c}, nil }
+func (c *memConn) Close() error { return nil }
+func (c *memConn) Begin() (driver.Tx, error) { return nil, errors.New("no transactions") }
+func (s *memStmt) Close() error { return nil }
+func (s *memStmt) NumInput() int { return -1 }
+func (s *memStmt) Exec(args []driver.Value) (driver.Result, error) { return nil, errors.New("no exec") }
+func (s *memStmt) Query(args []driver.Value) (driver.Rows, error) { return &memRows{s.conn.values, s.conn.err, s.conn.columns}, nil }
+func (r *memRows) Close() error { return nil }
+
+func (r *memRows) Columns() []string {
+    if len(r.columns) == 0 {
+        return []string{"A"}
+    }
+    names := make([]string, len(r.columns))
+    for i, c := range r.columns {
+        names[i] = c.name
+    }
+    return names
+}
+
+func (r *memRows) ColumnTypeDatabaseTypeName(i int) string {
+    if len(r.columns) == 0 {
+        return ""
+    }
+    return r.columns[i].typeName
+}
+
+func (r *memRows) ColumnTypePrecisionScale(i int) (int64, int64, bool) {
+    if len(r.columns) == 0 || r.columns[i].typeName != "NUMBER" {
+        return 0, 0, false
+    }
+    return r.columns[i].precision, r.columns[i].scale, true
+}
+
+func (r *memRows) ColumnTypeLength(i int) (int64, bool) {
+    if len(r.columns) == 0 || r.columns[i].length == 0 {
+        return 0, false
+    }
+    return r.columns[i].length, true
+}
+
+func (r *memRows) Next(dest []driver.Value) error {
+    if len(r.values) == 0 {
+        if r.err != nil {
+            return r.err
+        }
+        return io.EOF
+    }
+    copy(dest, r.values[0])
+    r.values = r.values[1:]
+    return nil
+}
+
+func init() {
+    sql.Register("mem", memDriver{})
+}
+
+func memDB(t *testing.T, name string, values [][]driver.Value, err error) *sql.DB {
+    memQueries[name] = &memConn{values: values, err: err}
+    db, err := sql.Open("mem", name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { db.Close() })
+    return db
+}
+
+func memQuery(t *testing.T, name string, values [][]driver.Value, err error) *sql.Rows {
+    rows, err := memDB(t, name, values, err).Query("select a from t")
+    if err != nil {
+        t.Fatal(err)
+    }
+    return rows
+}
+
+// Errors of the fetch and of a scan end the fetch and are returned, rows before them are written
+func TestFetchRowsError(t *testing.T) {
+    errFetch := errors.New("ORA-03113: end-of-file on communication channel")
+    tests := []struct {
+        name    string
+        values  [][]driver.Value
+        err     error
+        row     interface{}
+        lines   string
+    }{
+        {"fetch error", [][]driver.Value{{"a"}, {"b"}}, errFetch, &sql.NullString{}, "a\nb\n"},
+        {"scan error", [][]driver.Value{{"2024-01-31 00:00:00"}, {"b"}}, nil, &sql.NullTime{}, ""},
+    }
+
+    format, err := NewFormat(Params{}, ",", "\"", "double", "", "minimal", "LF")
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, tt := range tests {
+        rows := memQuery(t, tt.name, tt.values, tt.err)
+        row := []interface{}{tt.row}
+        formatters := []Formatter{format.NewFormatter(&sql.ColumnType{}, tt.row, nil)}
+
+        cRows := make(chan *RowBatch, 10)
+        _, n, err := FetchRows(rows, row, formatters, format, NewPipelineMetrics(), 0, cRows)
+        rows.Close()
+        close(cRows)
+
+        lines := ""
+        for batch := range cRows {
+            lines += string(batch.Lines)
+        }
+        if err == nil || (tt.err != nil && err != tt.err) {
+            t.Errorf("%s: error %v, want %v", tt.name, err, tt.err)
+        }
+        if lines != tt.lines || n != strings.Count(tt.lines, "\n") {
+            t.Errorf("%s: %d rows %q, want %q", tt.name, n, lines, tt.lines)
+        }
+    }
+}
+
+// Write errors of files and streams fail the export
+func TestWriteErrors(t *testing.T) {
+    if _, err := os.Stat("/dev/full"); err != nil {
+        t.Skip("no /dev/full")
+    }
+
+    for _, compress := range []bool{false, true} {
+        f, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+        if err != nil {
+            t.Fatal(err)
+        }
+        params := Params{Manifest: &Manifest{}, Metrics: NewPipelineMetrics(), PipelineBuffer: 1}
+        of := &OutputFile{f: f, w: bufio.NewWriterSize(f, 16), params: params}
+        done := make(chan struct{})
+        if compress {
+            of.cBatches = make(chan *RowBatch, 1)
+            go func() {
+                of.Compress()
+                close(done)
+            }()
+        }
+
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, strings.Repeat("line\n", 100)...)
+        batch.Rows = 100
+        of.Write(batch)
+        of.Close()
+        if compress {
+            <-done
+        }
+
+        if params.Manifest.Err() == nil {
+            t.Errorf("compress %v: export did not fail", compress)
+        }
+    }
+
+    r, w, err := os.Pipe()
+    if err != nil {
+        t.Fatal(err)
+    }
+    r.Close()
+    s := &Stream{f: w, w: bufio.NewWriterSize(w, 16)}
+    params := Params{Encoding: "utf-8", Stream: s, Manifest: &Manifest{}, Metrics: NewPipelineMetrics(), Progress: NewProgress()}
+
+    cRows := make(chan *RowBatch, 2)
+    for i := 0; i < 2; i++ {
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, strings.Repeat("line\n", 100)...)
+        batch.Rows = 100
+        cRows <- batch
+    }
+    close(cRows)
+
+    WriteToFile(0, 0, params, 100, cRows)
+    if params.Manifest.Err() == nil {
+        t.Errorf("stream: export did not fail")
+    }
+    s.Close()
+}
+
+func TestRenderQuery(t *testing.T) {
+    os.Setenv("EXPORT_TEST_ENV", "from_env")
+    defer os.Unsetenv("EXPORT_TEST_ENV")
+
+    vars := Vars{"TABLE": "car", "LoadDate": "2024-01-31", "EMPTY": "", "NESTED": "${TABLE}"}
+    tests := []struct {
+        name    string
+        query   string
+        want    string
+        err     bool
+    }{
+        {"no variables", "select * from car where id = :id", "select * from car where id = :id", false},
+        {"variable", "select * from ${TABLE} t", "select * from car t", false},
+        {"variable twice", "select '${TABLE}' from ${TABLE}", "select 'car' from car", false},
+        {"empty variable", "select 1${EMPTY} from dual", "select 1 from dual", false},
+        {"not expanded again", "select '${NESTED}' from dual", "select '${TABLE}' from dual", false},
+        {"template", "select * from car where d = date '{{.LoadDate}}'", "select * from car where d = date '2024-01-31'", false},
+        {"template condition", "select * from car{{if .TABLE}} where 1 = 1{{end}}", "select * from car where 1 = 1", false},
+        {"not a variable", "select '$TABLE', '${1X}' from dual", "select '$TABLE', '${1X}' from dual", false},
+        {"undefined variable", "select * from ${TABLES}", "", true},
+        {"environment variable", "select '${EXPORT_TEST_ENV}' from dual", "", true},
+        {"undefined template key", "select '{{.Missing}}' from dual", "", true},
+        {"template syntax", "select '{{.TABLE' from dual", "", true},
+    }
+
+    for _, tt := range tests {
+        got, err := RenderQuery(tt.query, vars)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if got != tt.want {
+            t.Errorf("%s: RenderQuery(%q) = %q, want %q", tt.name, tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestQueryArgs(t *testing.T) {
+    binds := map[string]interface{}{"snapshot_scn": "123", "row_count": 10, "mi": "bound"}
+    tests := []struct {
+        name    string
+        query   string
+        want    []interface{}
+    }{
+        {"no binds", "select * from car", []interface{}{}},
+        {"bind", "select * from car as of scn :snapshot_scn", []interface{}{sql.Named("snapshot_scn", "123")}},
+        {"case of the query", "select :ROW_COUNT from dual", []interface{}{sql.Named("ROW_COUNT", 10)}},
+        {"used twice", "select :row_count, :row_count from dual", []interface{}{sql.Named("row_count", 10)}},
+        {"order of the query", "select :row_count, :snapshot_scn from dual",
+            []interface{}{sql.Named("row_count", 10), sql.Named("snapshot_scn", "123")}},
+        {"unknown bind", "select :other from dual", []interface{}{}},
+        {"positional", "select :1 from dual", []interface{}{}},
+    }
+
+    for _, tt := range tests {
+        if got := QueryArgs(tt.query, binds); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: QueryArgs(%q) = %v, want %v", tt.name, tt.query, got, tt.want)
+        }
+    }
+}
+
+func TestRangeArgs(t *testing.T) {
+    r := Range{FirstValue: 100, LastValue: 199}
+    tests := []struct {
+        name    string
+        query   string
+        binds   map[string]interface{}
+        want    []interface{}
+    }{
+        {"positional", "select * from car where id between :1 and :2", nil, []interface{}{100, 199}},
+        {"named", "select * from car where id between :range_start and :range_end", nil,
+            []interface{}{sql.Named("range_start", 100), sql.Named("range_end", 199)}},
+        {"named and query binds", "select * from car as of scn :snapshot_scn where id >= :range_start and id <= :range_end",
+            map[string]interface{}{"snapshot_scn": "123"},
+            []interface{}{sql.Named("snapshot_scn", "123"), sql.Named("range_start", 100), sql.Named("range_end", 199)}},
+    }
+
+    for _, tt := range tests {
+        params := Params{Query: tt.query, Binds: tt.binds}
+        if got := RangeArgs(params, r); !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: RangeArgs = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+// With format workers batches reach the writers out of order, every writer
+// writes its share of batches in the order of Seq
+func TestPipelineWritersOrdered(t *testing.T) {
+    format, err := NewFormat(Params{}, ",", "\"", "double", "", "minimal", "LF")
+    if err != nil {
+        t.Fatal(err)
+    }
+    params := Params{FileName: filepath.Join(t.TempDir(), "out"), Encoding: "utf-8", Format: format, MaxSizeMB: 100,
+                     FormatWorkers: 2, Ordered: true, Writers: 3, PipelineBuffer: 16,
+                     Manifest: &Manifest{}, Metrics: NewPipelineMetrics(), Progress: NewProgress()}
+
+    p := StartPipeline(0, params)
+    for _, seq := range []int{5, 1, 0, 11, 3, 2, 8, 4, 10, 7, 6, 9} {
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, strconv.Itoa(seq) + "\n"...)
+        batch.Rows = 1
+        batch.Seq = seq
+        p.cRows <- batch
+    }
+    p.Close()
+
+    want := map[string]string{"out_1_0000001.csv": "0\n3\n6\n9\n", "out_2_0000001.csv": "1\n4\n7\n10\n",
+                              "out_3_0000001.csv": "2\n5\n8\n11\n"}
+    if err := params.Manifest.Err(); err != nil {
+        t.Fatal(err)
+    }
+    if len(params.Manifest.Files) != len(want) {
+        t.Fatalf("files %v, want %d", params.Manifest.Files, len(want))
+    }
+    for _, ef := range params.Manifest.Files {
+        content, err := ioutil.ReadFile(ef.Name)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if name := filepath.Base(ef.Name); string(content) != want[name] || ef.Rows != 4 {
+            t.Errorf("%s: %d rows %q, want %q", name, ef.Rows, content, want[name])
+        }
+    }
+}
+
+func TestEncode(t *testing.T) {
+    tests := []struct {
+        encoding    string
+        strict      bool
+        in          string
+        want        string
+        replaced    int
+        err         bool
+    }{
+        {"utf-8", false, "Москва €\n", "Москва €\n", 0, false},
+        {"utf-16le", false, "Aé\n", "A\x00\xe9\x00\n\x00", 0, false},
+        {"utf-16be", false, "Aé\n", "\x00A\x00\xe9\x00\n", 0, false},
+        {"utf-16le", false, "😀", "\x3d\xd8\x00\xde", 0, false},
+        {"utf-16be", false, "😀", "\xd8\x3d\xde\x00", 0, false},
+        {"utf-16le", false, "a\xffb", "a\x00\xfd\xffb\x00", 1, false},
+        {"utf-16le", false, "�", "\xfd\xff", 0, false},
+        {"utf-16be", true, "a\xffb", "", 0, true},
+        {"windows-1251", false, "Москва;1\n", "\xcc\xee\xf1\xea\xe2\xe0;1\n", 0, false},
+        {"windows-1252", false, "café €", "caf\xe9 \x80", 0, false},
+        {"iso-8859-1", false, "€ é Ж", "? \xe9 ?", 2, false},
+        {"iso-8859-1", false, "a\xffb", "a?b", 1, false},
+        {"iso-8859-1", true, "é Ж", "", 0, true},
+        {"koi8-r", false, "Ж", "\xf6", 0, false},
+        {"cp866", false, "Ж", "\x86", 0, false},
+    }
+
+    for _, tt := range tests {
+        e := NewEncoder(Params{Encoding: tt.encoding, EncodingStrict: tt.strict})
+        got, err := e.Encode([]byte(tt.in))
+        if (err != nil) != tt.err {
+            t.Errorf("%s %q: error %v, want error %v", tt.encoding, tt.in, err, tt.err)
+            continue
+        }
+        if !tt.err && (string(got) != tt.want || e.Replaced != tt.replaced) {
+            t.Errorf("%s %q: Encode = %q with %d replaced, want %q with %d", tt.encoding, tt.in, got, e.Replaced, tt.want, tt.replaced)
+        }
+    }
+}
+
+func TestEncodeBatch(t *testing.T) {
+    // Buffers of the batches and the encoder are swapped, batches keep their lines
+    e := NewEncoder(Params{Encoding: "windows-1251"})
+    batches := []*RowBatch{}
+    for _, line := range []string{"Да\n", "Нет\n"} {
+        batch := NewRowBatch()
+        batch.Lines = append(batch.Lines, line...)
+        if err := e.EncodeBatch(batch); err != nil {
+            t.Fatal(err)
+        }
+        batches = append(batches, batch)
+    }
+
+    for i, want := range []string{"\xc4\xe0\n", "\xcd\xe5\xf2\n"} {
+        if string(batches[i].Lines) != want {
+            t.Errorf("batch %d = %q, want %q", i, batches[i].Lines, want)
+        }
+    }
+}
+
+func TestEncodeInvalid(t *testing.T) {
+    for _, encoding := range []string{"utf-16le", "windows-1252"} {
+        e := NewEncoder(Params{Encoding: encoding})
+        if _, err := e.Encode([]byte("a\xffb\xfe\n")); err != nil {
+            t.Fatal(err)
+        }
+        if e.Invalid != 2 || e.Replaced != 2 {
+            t.Errorf("%s: %d invalid, %d replaced, want 2 and 2", encoding, e.Invalid, e.Replaced)
+        }
+    }
+}
+
+func TestStrftimeToLayout(t *testing.T) {
+    tests := []struct {
+        format  string
+        want    string
+        err     bool
+    }{
+        {"%Y-%m-%d %H:%M:%S", "2006-01-02 15:04:05", false},
+        {"%d.%m.%y %I:%M %p", "02.01.06 03:04 PM", false},
+        {"%Y-%m-%dT%H:%M:%S.%f%z", "2006-01-02T15:04:05.000000-0700", false},
+        {"%Y%j %H%M%S.%N %Z", "2006002 150405.000000000 MST", false},
+        {"%a, %d %b %Y", "Mon, 02 Jan 2006", false},
+        {"%A %B", "Monday January", false},
+        {"100%% %Y", "100% 2006", false},
+        {"no directives", "no directives", false},
+        {"%Y-%m-%", "", true},
+        {"%Y-%Q", "", true},
+    }
+
+    for _, tt := range tests {
+        got, err := StrftimeToLayout(tt.format)
+        if (err != nil) != tt.err || got != tt.want {
+            t.Errorf("StrftimeToLayout(%q) = %q, %v, want %q, error %v", tt.format, got, err, tt.want, tt.err)
+        }
+    }
+}
+
+func TestLayoutToMask(t *testing.T) {
+    tests := []struct {
+        layout  string
+        want    string
+        ok      bool
+    }{
+        {"2006-01-02 15:04:05", "YYYY-MM-DD HH24:MI:SS", true},
+        {"2006-01-02 15:04:05.000000000", "YYYY-MM-DD HH24:MI:SS.FF9", true},
+        {"2006-01-02 15:04:05.000000000 -0700", "YYYY-MM-DD HH24:MI:SS.FF9 TZHTZM", true},
+        {"2006-01-02T15:04:05.000000000-07:00", "YYYY-MM-DD\"T\"HH24:MI:SS.FF9TZH:TZM", true},
+        {"02.01.2006 15:04:05.000", "DD.MM.YYYY HH24:MI:SS.FF3", true},
+        {"2006-01-02 15:04:05.000000", "YYYY-MM-DD HH24:MI:SS.FF6", true},
+        {"epoch", "", false},
+        {"epochms", "", false},
+        {"2006-01-02 15:04:05.999999999", "", false},
+        {time.RFC3339, "", false},
+        {time.RFC3339Nano, "", false},
+        {"02 Jan 2006", "", false},
+        {"03:04 PM", "", false},
+    }
+
+    for _, tt := range tests {
+        got, ok := LayoutToMask(tt.layout)
+        if ok != tt.ok || got != tt.want {
+            t.Errorf("LayoutToMask(%q) = %q, %v, want %q, %v", tt.layout, got, ok, tt.want, tt.ok)
+        }
+    }
+}
+
+func TestNewTimeLayouts(t *testing.T) {
+    tests := []struct {
+        name            string
+        date            string
+        timestamp       string
+        timestampTz     string
+        want            map[string]string
+        err             bool
+    }{
+        {"defaults", "", "", "", TimeLayouts, false},
+        {"layout, strftime and epoch", "02.01.2006", "%Y-%m-%d %H:%M:%S.%f", "epochms", map[string]string{
+            "DATE": "02.01.2006", "TIMESTAMP": "2006-01-02 15:04:05.000000",
+            "TIMESTAMP WITH TIME ZONE": "epochms", "TIMESTAMP WITH LOCAL TIME ZONE": "2006-01-02 15:04:05.000000"}, false},
+        {"preset", "ISO8601", "iso8601", "iso8601", timePresets["iso8601"], false},
+        {"wrong strftime", "%Q", "", "", nil, true},
+    }
+
+    for _, tt := range tests {
+        got, err := NewTimeLayouts(tt.date, tt.timestamp, tt.timestampTz)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s: NewTimeLayouts = %v, want %v", tt.name, got, tt.want)
+        }
+    }
+}
+
+func TestParseFlags(t *testing.T) {
+    config := filepath.Join(t.TempDir(), "jobs.yaml")
+    err := ioutil.WriteFile(config, []byte(`
+connections:
+  prod: user/pw@prod:1521/orcl
+  dwh: account/db/schema
+profiles:
+  nightly:
+    parallel: 2
+    compress: true
+    ddl: [oracle, snowflake]
+jobs:
+  cars:
+    profile: nightly
+    conn: prod
+    query: car.sql
+    parallel: 4
+    var:
+      TABLE: car
+      DAY: monday
+  plain:
+    query: plain.sql
+  missing_profile:
+    profile: weekly
+  unknown:
+    colour: red
+`), 0644)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        name    string
+        args    []string
+        want    map[string]string
+        err     bool
+    }{
+        {"job over profile", []string{"run", "cars", "-config", config},
+            map[string]string{"conn": "user/pw@prod:1521/orcl", "query": "car.sql", "parallel": "4", "compress": "true",
+                              "ddl": "oracle,snowflake", "var": "DAY=monday,TABLE=car"}, false},
+        {"command line over job", []string{"run", "cars", "-config", config, "-parallel=8", "-compress=false", "-var", "DAY=friday"},
+            map[string]string{"parallel": "8", "compress": "false", "var": "DAY=friday,TABLE=car"}, false},
+        {"connection name of the command line", []string{"run", "plain", "-config", config, "-conn=prod", "-sfConn=dwh"},
+            map[string]string{"conn": "user/pw@prod:1521/orcl", "sfConn": "account/db/schema", "query": "plain.sql"}, false},
+        {"connection name over job", []string{"run", "cars", "-config", config, "-conn=dwh"},
+            map[string]string{"conn": "account/db/schema"}, false},
+        {"connection string", []string{"run", "cars", "-config", config, "-conn=user/other@test:1521/orcl"},
+            map[string]string{"conn": "user/other@test:1521/orcl"}, false},
+        {"configuration without job", []string{"-config", config, "-conn=prod", "-targetConn=dwh"},
+            map[string]string{"conn": "user/pw@prod:1521/orcl", "targetConn": "account/db/schema", "parallel": "1"}, false},
+        {"no run", []string{"-conn=prod", "-query=car.sql"},
+            map[string]string{"conn": "prod", "query": "car.sql"}, false},
+        {"unknown job", []string{"run", "trucks", "-config", config}, nil, true},
+        {"unknown profile", []string{"run", "missing_profile", "-config", config}, nil, true},
+        {"unknown parameter", []string{"run", "unknown", "-config", config}, nil, true},
+        {"missing file", []string{"run", "cars", "-config", config + ".missing"}, nil, true},
+    }
+
+    for _, tt := range tests {
+        fs := flag.NewFlagSet("ExportData", flag.ContinueOnError)
+        fs.SetOutput(ioutil.Discard)
+        for _, name := range []string{"conn", "targetConn", "sfConn", "query", "ddl"} {
+            fs.String(name, "", "")
+        }
+        fs.String("config", "ExportData.yaml", "")
+        fs.Int("parallel", 1, "")
+        fs.Bool("compress", false, "")
+        fs.Var(Vars{}, "var", "")
+
+        err := ParseFlags(fs, tt.args)
+        if (err != nil) != tt.err {
+            t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+            continue
+        }
+        for name, want := range tt.want {
+            if got := fs.Lookup(name).Value.String(); got != want {
+                t.Errorf("%s: -%s = %q, want %q", tt.name, name, got, want)
+            }
+        }
+    }
+}
+
+func TestWatermarkName(t *testing.T) {
+    tests := []struct {
+        watermarkType   string
+        value           string
+        want            string
+    }{
+        {"number", "", "begin"},
+        {"timestamp", "", "begin"},
+        {"number", "1234", "1234"},
+        {"number", "-12.5", "m12p5"},
+        {"timestamp", "2024-01-31T12:30:45.123456Z", "20240131T123045"},
+        {"timestamp", "2024-01-31T12:30:45+02:00", "20240131T123045"},
+        {"timestamp", "2024-01-31", "2024m01m31"},
+    }
+
+    for _, tt := range tests {
+        if got := WatermarkName(tt.watermarkType, tt.value); got != tt.want {
+            t.Errorf("%s %q: WatermarkName = %q, want %q", tt.watermarkType, tt.value, got, tt.want)
+        }
+    }
+}
+
+func TestWatermarkBind(t *testing.T) {
+    tests := []struct {
+        watermarkType   string
+        value           string
+        want            interface{}
+        err             bool
+    }{
+        {"number", "", -1e125, false},
+        {"number", "42.5", "42.5", false},
+        {"timestamp", "", time.Date(1, 1, 1, 0, 0, 0, 0, time.UTC), false},
+        {"timestamp", "2024-01-31T12:30:45.5Z", time.Date(2024, 1, 31, 12, 30, 45, 500000000, time.UTC), false},
+        {"timestamp", "2024-01-31", nil, true},
+    }
+
+    for _, tt := range tests {
+        got, err := WatermarkBind(tt.watermarkType, tt.value)
+        if (err != nil) != tt.err {
+            t.Errorf("%s %q: error %v, want error %v", tt.watermarkType, tt.value, err, tt.err)
+            continue
+        }
+        if !tt.err && !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("%s %q: WatermarkBind = %#v, want %#v", tt.watermarkType, tt.value, got, tt.want)
+        }
+    }
+}
+
+// Errors of the type, the binds and the state file are returned before connecting
+func TestStartIncrementalErrors(t *testing.T) {
+    stateFile := filepath.Join(t.TempDir(), "state.json")
+    if err := SaveWatermark(stateFile, &Watermark{Column: "UPDATED_AT", Type: "timestamp", Value: "2024-01-31T00:00:00Z"}); err != nil {
+        t.Fatal(err)
+    }
+    query := "select * from t where id > :watermark_start and id <= :watermark_end"
+
+    tests := []struct {
+        name            string
+        query           string
+        column          string
+        watermarkType   string
+    }{
+        {"unknown type", query, "ID", "date"},
+        {"missing binds", "select * from t where id > :watermark_start", "ID", "number"},
+        {"state of another column", query, "ID", "timestamp"},
+        {"state of another type", query, "UPDATED_AT", "number"},
+    }
+
+    for _, tt := range tests {
+        params := &Params{Query: tt.query, Binds: map[string]interface{}{}}
+        if _, err := StartIncremental(params, tt.column, tt.watermarkType, stateFile, map[string]interface{}{}); err == nil {
+            t.Errorf("%s: no error", tt.name)
+        }
+    }
+}
+
+// The maximum value of the column is the end of the interval, bound and added to the file name
+func TestReadWatermark(t *testing.T) {
+    end := time.Date(2024, 2, 1, 8, 0, 0, 0, time.UTC)
+    tests := []struct {
+        name            string
+        watermarkType   string
+        start           string
+        value           driver.Value
+        sql             string
+        want            string
+        fileName        string
+    }{
+        {"number", "number", "", "1500", "select to_char(max(\"ID\")) from (q)", "1500", "out_begin_1500"},
+        {"timestamp", "timestamp", "2024-01-31T00:00:00Z", end, "select max(\"ID\") from (q)", "2024-02-01T08:00:00Z", "out_20240131T000000_20240201T080000"},
+        {"no new rows", "number", "1500", nil, "select to_char(max(\"ID\")) from (q)", "", "out"},
+    }
+
+    for _, tt := range tests {
+        db := memDB(t, "watermark " + tt.name, [][]driver.Value{{tt.value}}, nil)
+        params := &Params{Query: "q", FileName: "out", Binds: map[string]interface{}{}}
+        startBind, err := WatermarkBind(tt.watermarkType, tt.start)
+        if err != nil {
+            t.Fatal(err)
+        }
+        binds := map[string]interface{}{"watermark_start": startBind}
+
+        w, err := ReadWatermark(db, params, "id", tt.watermarkType, tt.start, binds)
+        if err != nil {
+            t.Errorf("%s: %v", tt.name, err)
+            continue
+        }
+        if query := memQueries["watermark " + tt.name].query; query != tt.sql {
+            t.Errorf("%s: query %q, want %q", tt.name, query, tt.sql)
+        }
+        if params.FileName != tt.fileName {
+            t.Errorf("%s: file name %q, want %q", tt.name, params.FileName, tt.fileName)
+        }
+        if tt.value == nil {
+            if w != nil || len(params.Binds) != 0 {
+                t.Errorf("%s: watermark %v, binds %v, want none", tt.name, w, params.Binds)
+            }
+            continue
+        }
+        if w == nil || w.Value != tt.want || w.Start != tt.start || w.Column != "id" {
+            t.Errorf("%s: watermark %+v, want value %q after %q", tt.name, w, tt.want, tt.start)
+            continue
+        }
+        if params.Binds["watermark_start"] != startBind || params.Binds["watermark_end"] == nil {
+            t.Errorf("%s: binds %v", tt.name, params.Binds)
+        }
+    }
+}
+
+// NUMBER without precision has the -sfNumber type in Snowflake, other dialects keep a decimal type
+func TestColumnDDLNumber(t *testing.T) {
+    columns := []memColumn{
+        {"N", "NUMBER", 0, -127, 0},
+        {"F", "NUMBER", 126, -127, 0},
+        {"D", "NUMBER", 12, 2, 0},
+        {"S", "VARCHAR2", 0, 0, 30},
+    }
+    tests := []struct {
+        dialect     string
+        sfNumber    string
+        want        []string
+    }{
+        {"snowflake", "FLOAT", []string{"FLOAT", "FLOAT", "NUMBER(12,2)", "VARCHAR(30)"}},
+        {"snowflake", "VARCHAR", []string{"VARCHAR", "FLOAT", "NUMBER(12,2)", "VARCHAR(30)"}},
+        {"postgres", "FLOAT", []string{"NUMERIC", "DOUBLE PRECISION", "NUMERIC(12,2)", "VARCHAR(30)"}},
+        {"bigquery", "FLOAT", []string{"BIGNUMERIC", "FLOAT64", "NUMERIC(12,2)", "STRING"}},
+        {"oracle", "FLOAT", []string{"NUMBER", "NUMBER", "NUMBER(12,2)", "VARCHAR2(30)"}},
+    }
+
+    memQueries["ddl"] = &memConn{columns: columns}
+    db, err := sql.Open("mem", "ddl")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer db.Close()
+    rows, err := db.Query("select * from t")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer rows.Close()
+    columnTypes, err := rows.ColumnTypes()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    for _, tt := range tests {
+        for i, c := range columnTypes {
+            if got := ColumnDDL(tt.dialect, c, tt.sfNumber); got != tt.want[i] {
+                t.Errorf("%s %s: ColumnDDL = %q, want %q", tt.dialect, c.Name(), got, tt.want[i])
+            }
+        }
+    }
+}
@@ -61,12 +61,25 @@ func NullStringToString(v sql.NullString, columnType string) string {
     }
 
     if columnType == "FIXED" {
-        return strings.TrimRight(v.String, ".0")
+        return NormalizeNumber(v.String)
     }
 
     return v.String
 }
 
+// NormalizeNumber removes trailing zeros of the fraction, "100" stays "100", "1.50" is "1.5"
+func NormalizeNumber(s string) string {
+    if !strings.Contains(s, ".") {
+        return s
+    }
+
+    s = strings.TrimSuffix(strings.TrimRight(s, "0"), ".")
+    if s == "-0" {
+        return "0"
+    }
+    return s
+}
+
 func NullTimeToString(v sql.NullTime, columnType string) string {
     if !v.Valid {
         return ""
@@ -112,7 +125,7 @@ func DefineColumnTypes(rows *sql.Rows) (columnTypes []*sql.ColumnType, row []int
         } else if c.DatabaseTypeName() == "TIMESTAMP_NTZ" || c.DatabaseTypeName() == "TIMESTAMP_TZ" || c.DatabaseTypeName() == "TIMESTAMP_LTZ" {
             row = append(row, &sql.NullTime {time.Time{}, false})
         } else {
-            fmt.Println("Unexpected type: %s ", c.DatabaseTypeName())
+            fmt.Println("Unexpected type:", c.DatabaseTypeName())
         	err = fmt.Errorf("Unexpected type: %s ", c.DatabaseTypeName())
         }
     }
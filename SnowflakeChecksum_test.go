@@ -0,0 +1,31 @@
+package main
+
+import (
+    "testing"
+)
+
+// Snowflake returns FIXED values with the scale of the column, the normalized
+// text must be the Oracle text of ExportData (see TestDecimalMatchesSnowflake)
+func TestNormalizeNumber(t *testing.T) {
+    for _, tc := range []struct {
+        in      string
+        want    string
+    }{
+        {"100", "100"},
+        {"1", "1"},
+        {"10", "10"},
+        {"100.000", "100"},
+        {"1.500000", "1.5"},
+        {"-0.250", "-0.25"},
+        {"0.000", "0"},
+        {"-0.000", "0"},
+        {"0.100", "0.1"},
+        {"-1.2300", "-1.23"},
+        {"12345678901234567890123456789012345678", "12345678901234567890123456789012345678"},
+        {"1234567890123456789012345678.0000000000", "1234567890123456789012345678"},
+    } {
+        if got := NormalizeNumber(tc.in); got != tc.want {
+            t.Errorf("NormalizeNumber(%q) = %q, want %q", tc.in, got, tc.want)
+        }
+    }
+}